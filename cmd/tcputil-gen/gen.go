@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	kindFixed = iota
+	kindString
+	kindBytes
+	kindStruct
+	kindSlice
+)
+
+// 基础数值类型对应的TcpOutput和TcpInput方法以及字节数
+var fixedTypes = map[string]struct {
+	method string
+	size   int
+}{
+	"bool":    {"Bool", 1},
+	"int8":    {"Int8", 1},
+	"uint8":   {"Uint8", 1},
+	"byte":    {"Uint8", 1},
+	"int16":   {"Int16", 2},
+	"uint16":  {"Uint16", 2},
+	"int32":   {"Int32", 4},
+	"uint32":  {"Uint32", 4},
+	"int64":   {"Int64", 8},
+	"uint64":  {"Uint64", 8},
+	"float32": {"Float32", 4},
+	"float64": {"Float64", 8},
+}
+
+// 一个字段或者切片元素的编码方式
+type codec struct {
+	kind   int
+	goType string // 字段的Go类型
+	basic  string // 数值类型对应的基础类型，跟goType不一样时需要类型转换
+	method string // 数值类型的读写方法后缀，或者长度前缀的读写方法后缀
+	size   int    // 数值类型的字节数，或者长度前缀的字节数
+	elem   *codec // 切片元素
+}
+
+type generator struct {
+	types   map[string]ast.Expr // 包中所有类型定义
+	tcputil string              // 生成代码中tcputil包的限定名
+	buf     bytes.Buffer
+	vars    int
+}
+
+//
+// 为'typeNames'中的结构体生成代码，'files'是结构体所在包的所有源文件。
+//
+func generate(files []*ast.File, typeNames []string, tcputilPath string) ([]byte, error) {
+	var this = &generator{
+		types:   make(map[string]ast.Expr),
+		tcputil: tcputilPath[strings.LastIndex(tcputilPath, "/")+1:],
+	}
+
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			if decl, ok := decl.(*ast.GenDecl); ok {
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok && spec.TypeParams == nil {
+						this.types[spec.Name.Name] = spec.Type
+					}
+				}
+			}
+		}
+	}
+
+	this.printf("// Code generated by tcputil-gen. DO NOT EDIT.\n\n")
+	this.printf("package %s\n\n", files[0].Name.Name)
+	this.printf("import %q\n", tcputilPath)
+
+	for _, name := range typeNames {
+		var structType, ok = this.types[strings.TrimSpace(name)].(*ast.StructType)
+
+		if !ok {
+			return nil, fmt.Errorf("struct type %s not found", name)
+		}
+
+		if err := this.genStruct(strings.TrimSpace(name), structType); err != nil {
+			return nil, err
+		}
+	}
+
+	var code, err = format.Source(this.buf.Bytes())
+
+	if err != nil {
+		return nil, fmt.Errorf("bad generated code: %v", err)
+	}
+
+	return code, nil
+}
+
+func (this *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&this.buf, format, args...)
+}
+
+func (this *generator) newVar(prefix string) string {
+	this.vars++
+	return prefix + strconv.Itoa(this.vars)
+}
+
+type field struct {
+	name  string
+	codec *codec
+}
+
+func (this *generator) genStruct(name string, structType *ast.StructType) error {
+	var fields []field
+
+	for _, f := range structType.Fields.List {
+		var c, err = this.fieldCodec(f)
+
+		if err != nil {
+			if len(f.Names) > 0 {
+				return fmt.Errorf("%s.%s: %v", name, f.Names[0].Name, err)
+			}
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		if c == nil {
+			continue
+		}
+
+		for _, fieldName := range f.Names {
+			if fieldName.Name != "_" {
+				fields = append(fields, field{fieldName.Name, c})
+			}
+		}
+	}
+
+	this.vars = 0
+	this.genSize(name, fields)
+	this.vars = 0
+	this.genMarshal(name, fields)
+	this.vars = 0
+	this.genUnmarshal(name, fields)
+
+	return nil
+}
+
+// 根据字段类型和tag确定编码方式，需要跳过的字段返回nil
+func (this *generator) fieldCodec(f *ast.Field) (*codec, error) {
+	var tag string
+
+	if f.Tag != nil {
+		var value, _ = strconv.Unquote(f.Tag.Value)
+		tag = reflect.StructTag(value).Get("tcputil")
+	}
+
+	if tag == "-" {
+		return nil, nil
+	}
+
+	if len(f.Names) == 0 {
+		return nil, fmt.Errorf("embedded field is not supported")
+	}
+
+	var prefixes []int
+
+	if tag != "" {
+		for _, item := range strings.Split(tag, ",") {
+			var bits, err = strconv.Atoi(strings.TrimSpace(item))
+
+			if err != nil || (bits != 8 && bits != 16 && bits != 32) {
+				return nil, fmt.Errorf("bad tag %q", tag)
+			}
+
+			prefixes = append(prefixes, bits/8)
+		}
+	}
+
+	return this.newCodec(f.Type, prefixes)
+}
+
+// 长度前缀的字节数对应的读写方法后缀
+var prefixMethods = map[int]string{1: "Uint8", 2: "Uint16", 4: "Uint32"}
+
+func (this *generator) newCodec(expr ast.Expr, prefixes []int) (*codec, error) {
+	var prefix = 2
+
+	if len(prefixes) > 0 {
+		prefix, prefixes = prefixes[0], prefixes[1:]
+	}
+
+	var c = &codec{goType: types.ExprString(expr)}
+
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		if fixed, ok := fixedTypes[expr.Name]; ok {
+			c.kind, c.basic, c.method, c.size = kindFixed, expr.Name, fixed.method, fixed.size
+			return c, nil
+		}
+
+		if expr.Name == "string" {
+			c.kind, c.method, c.size = kindString, prefixMethods[prefix], prefix
+			return c, nil
+		}
+
+		switch underlying := this.types[expr.Name].(type) {
+		case *ast.StructType:
+			c.kind = kindStruct
+			return c, nil
+		case *ast.Ident:
+			// 基于数值类型定义的类型，例如 type UserId uint32
+			if fixed, ok := fixedTypes[underlying.Name]; ok {
+				c.kind, c.basic, c.method, c.size = kindFixed, underlying.Name, fixed.method, fixed.size
+				return c, nil
+			}
+		}
+	case *ast.SelectorExpr:
+		// 其他包中的类型，认为已经实现了需要的方法
+		c.kind = kindStruct
+		return c, nil
+	case *ast.ArrayType:
+		if expr.Len != nil {
+			break
+		}
+
+		if elem, ok := expr.Elt.(*ast.Ident); ok && (elem.Name == "byte" || elem.Name == "uint8") {
+			c.kind, c.method, c.size = kindBytes, prefixMethods[prefix], prefix
+			return c, nil
+		}
+
+		var elem, err = this.newCodec(expr.Elt, prefixes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.kind, c.method, c.size, c.elem = kindSlice, prefixMethods[prefix], prefix, elem
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %s", c.goType)
+}
+
+func (this *generator) genSize(name string, fields []field) {
+	var (
+		fixed int
+		terms []string
+		loops bytes.Buffer
+	)
+
+	for _, f := range fields {
+		var expr = "this." + f.name
+
+		switch f.codec.kind {
+		case kindFixed:
+			fixed += f.codec.size
+		case kindString, kindBytes:
+			fixed += f.codec.size
+			terms = append(terms, "len("+expr+")")
+		case kindStruct:
+			terms = append(terms, expr+".Size()")
+		case kindSlice:
+			fixed += f.codec.size
+			this.sizeLoop(&loops, expr, f.codec.elem)
+		}
+	}
+
+	this.printf("\n// Size 返回%s编码以后的字节数\n", name)
+	this.printf("func (this *%s) Size() int {\n", name)
+	this.printf("var size = %s\n", strings.Join(append([]string{strconv.Itoa(fixed)}, terms...), " + "))
+	this.buf.Write(loops.Bytes())
+	this.printf("return size\n}\n")
+}
+
+func (this *generator) sizeLoop(w *bytes.Buffer, expr string, elem *codec) {
+	switch elem.kind {
+	case kindFixed:
+		fmt.Fprintf(w, "size += %d * len(%s)\n", elem.size, expr)
+		return
+	case kindString, kindBytes:
+		fmt.Fprintf(w, "size += %d * len(%s)\n", elem.size, expr)
+	}
+
+	var i = this.newVar("i")
+
+	fmt.Fprintf(w, "for %s := range %s {\n", i, expr)
+
+	var item = expr + "[" + i + "]"
+
+	switch elem.kind {
+	case kindString, kindBytes:
+		fmt.Fprintf(w, "size += len(%s)\n", item)
+	case kindStruct:
+		fmt.Fprintf(w, "size += %s.Size()\n", item)
+	case kindSlice:
+		fmt.Fprintf(w, "size += %d\n", elem.size)
+		this.sizeLoop(w, item, elem.elem)
+	}
+
+	fmt.Fprintf(w, "}\n")
+}
+
+func (this *generator) genMarshal(name string, fields []field) {
+	this.printf("\n// MarshalTo 把%s写入'out'，'out'的剩余空间不能小于Size的返回值，字符串或切片的长度超过8位或16位长度前缀的范围时panic\n", name)
+	this.printf("func (this *%s) MarshalTo(out *%s.TcpOutput) *%s.TcpOutput {\n", name, this.tcputil, this.tcputil)
+
+	for _, f := range fields {
+		this.marshal("this."+f.name, name+"."+f.name, f.codec)
+	}
+
+	this.printf("return out\n}\n")
+}
+
+// 长度前缀写不下时panic，不能写出截断的长度，否则对方无法解码，'label'用于说明是哪个字段
+func (this *generator) checkPrefix(expr, label string, c *codec) {
+	if c.size >= 4 {
+		return
+	}
+
+	this.printf("if len(%s) > %#x {\n", expr, 1<<(8*uint(c.size))-1)
+	this.printf("panic(%q)\n}\n", fmt.Sprintf("tcputil-gen: %s is too long for its %d-bit length prefix", label, 8*c.size))
+}
+
+func (this *generator) marshal(expr, label string, c *codec) {
+	switch c.kind {
+	case kindFixed:
+		if c.goType != c.basic {
+			expr = c.basic + "(" + expr + ")"
+		}
+		this.printf("out.Write%s(%s)\n", c.method, expr)
+	case kindString:
+		this.checkPrefix(expr, label, c)
+		this.printf("out.WriteString%s(%s)\n", strings.TrimPrefix(c.method, "Uint"), expr)
+	case kindBytes:
+		this.checkPrefix(expr, label, c)
+		this.printf("out.WriteBytes%s(%s)\n", strings.TrimPrefix(c.method, "Uint"), expr)
+	case kindStruct:
+		this.printf("%s.MarshalTo(out)\n", expr)
+	case kindSlice:
+		var i = this.newVar("i")
+
+		this.checkPrefix(expr, label, c)
+		this.printf("out.Write%s(%s(len(%s)))\n", c.method, strings.ToLower(c.method), expr)
+		this.printf("for %s := range %s {\n", i, expr)
+		this.marshal(expr+"["+i+"]", label+"[]", c.elem)
+		this.printf("}\n")
+	}
+}
+
+func (this *generator) genUnmarshal(name string, fields []field) {
+	this.printf("\n// UnmarshalFrom 从'in'读取%s，数据不完整时返回%s.ErrInputTooShort\n", name, this.tcputil)
+	this.printf("func (this *%s) UnmarshalFrom(in *%s.TcpInput) error {\n", name, this.tcputil)
+
+	for i, f := range fields {
+		// 连续的数值字段只需要检查一次长度
+		if f.codec.kind == kindFixed && (i == 0 || fields[i-1].codec.kind != kindFixed) {
+			var size int
+
+			for j := i; j < len(fields) && fields[j].codec.kind == kindFixed; j++ {
+				size += fields[j].codec.size
+			}
+
+			this.checkLen(strconv.Itoa(size))
+		}
+
+		this.unmarshal("this."+f.name, f.codec, f.codec.kind == kindFixed)
+	}
+
+	this.printf("return nil\n}\n")
+}
+
+func (this *generator) checkLen(size string) {
+	this.printf("if len(in.Data) < %s {\nreturn %s.ErrInputTooShort\n}\n", size, this.tcputil)
+}
+
+func (this *generator) unmarshal(expr string, c *codec, checked bool) {
+	switch c.kind {
+	case kindFixed:
+		if !checked {
+			this.checkLen(strconv.Itoa(c.size))
+		}
+
+		if c.goType != c.basic {
+			this.printf("%s = %s(in.Read%s())\n", expr, c.goType, c.method)
+		} else {
+			this.printf("%s = in.Read%s()\n", expr, c.method)
+		}
+	case kindString, kindBytes:
+		var n = this.newVar("n")
+
+		this.checkLen(strconv.Itoa(c.size))
+		this.printf("var %s = int(in.Read%s())\n", n, c.method)
+		this.checkLen(n)
+
+		if c.kind == kindString {
+			this.printf("%s = string(in.ReadBytes(%s))\n", expr, n)
+		} else {
+			// 复制一份，消息包的内存可能会被还给内存池
+			this.printf("%s = append([]byte(nil), in.ReadBytes(%s)...)\n", expr, n)
+		}
+	case kindStruct:
+		this.printf("if err := %s.UnmarshalFrom(in); err != nil {\nreturn err\n}\n", expr)
+	case kindSlice:
+		var (
+			n = this.newVar("n")
+			i = this.newVar("i")
+		)
+
+		this.checkLen(strconv.Itoa(c.size))
+		this.printf("var %s = int(in.Read%s())\n", n, c.method)
+
+		// 先按元素的最小长度检查，避免恶意的元素个数导致申请大量内存
+		if min := this.minSize(c.elem, nil); min > 0 {
+			this.checkLen(fmt.Sprintf("%d*%s", min, n))
+		}
+
+		this.printf("%s = make(%s, %s)\n", expr, c.goType, n)
+		this.printf("for %s := range %s {\n", i, expr)
+		this.unmarshal(expr+"["+i+"]", c.elem, c.elem.kind == kindFixed)
+		this.printf("}\n")
+	}
+}
+
+// 元素编码以后至少有多少字节，用于检查元素个数是否合理，'visiting'用于避免递归类型死循环
+func (this *generator) minSize(c *codec, visiting map[string]bool) int {
+	switch c.kind {
+	case kindFixed, kindString, kindBytes, kindSlice:
+		return c.size
+	}
+
+	var structType, ok = this.types[c.goType].(*ast.StructType)
+
+	if !ok || visiting[c.goType] {
+		return 0
+	}
+
+	if visiting == nil {
+		visiting = make(map[string]bool)
+	}
+
+	visiting[c.goType] = true
+	defer delete(visiting, c.goType)
+
+	var size int
+
+	for _, f := range structType.Fields.List {
+		// 出错的字段在生成这个结构体的代码时会报告，这里不用管
+		if fc, err := this.fieldCodec(f); err == nil && fc != nil {
+			for _, fieldName := range f.Names {
+				if fieldName.Name != "_" {
+					size += this.minSize(fc, visiting)
+				}
+			}
+		}
+	}
+
+	return size
+}
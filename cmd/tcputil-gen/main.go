@@ -0,0 +1,130 @@
+//
+// tcputil-gen根据结构体定义生成Size、MarshalTo和UnmarshalFrom方法，用于在TcpOutput和TcpInput中读写消息，不需要反射。
+//
+// 用法，在结构体所在的文件中加上：
+//
+//	//go:generate go run <tcputil的导入路径>/cmd/tcputil-gen -type=Login,Logout
+//
+// 支持的字段类型：
+//
+//	bool, int8, uint8, byte, int16, uint16, int32, uint32, int64, uint64, float32, float64 以及基于它们定义的类型
+//	string, []byte   带长度前缀，默认是16位，可以用`tcputil:"8"`、`tcputil:"16"`、`tcputil:"32"`设置
+//	结构体           调用它的Size、MarshalTo和UnmarshalFrom方法，通常也是用tcputil-gen生成的
+//	切片             带元素个数前缀，位数设置同上，元素是字符串或[]byte时用`tcputil:"16,8"`的第二个数字设置元素的长度前缀
+//
+// 不需要编码的字段用`tcputil:"-"`跳过。
+// 长度超过长度前缀范围的字段，例如用`tcputil:"8"`的字符串超过255字节，MarshalTo会panic，而不是写出对方无法解码的数据。
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+)
+
+var (
+	typeNames  = flag.String("type", "", "要生成方法的结构体名称，多个用逗号分隔，必须设置")
+	output     = flag.String("output", "", "输出文件名，默认是<源文件名>_tcputil.go")
+	importPath = flag.String("import", "", "tcputil的导入路径，默认根据tcputil-gen自身的路径推断")
+)
+
+func main() {
+	flag.Parse()
+
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var dir = "."
+
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	if err := run(dir); err != nil {
+		fmt.Fprintln(os.Stderr, "tcputil-gen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string) error {
+	var outputName = *output
+
+	if outputName == "" {
+		if file := os.Getenv("GOFILE"); file != "" {
+			outputName = strings.TrimSuffix(file, ".go") + "_tcputil.go"
+		} else {
+			outputName = strings.ToLower(strings.Split(*typeNames, ",")[0]) + "_tcputil.go"
+		}
+	}
+
+	outputName = filepath.Join(dir, outputName)
+
+	var tcputilPath = *importPath
+
+	if tcputilPath == "" {
+		var info, ok = debug.ReadBuildInfo()
+
+		if !ok || !strings.HasSuffix(info.Path, "/cmd/tcputil-gen") {
+			return fmt.Errorf("can't infer tcputil import path, please set -import")
+		}
+
+		tcputilPath = strings.TrimSuffix(info.Path, "/cmd/tcputil-gen")
+	}
+
+	var files, err1 = parseDir(dir, outputName)
+
+	if err1 != nil {
+		return err1
+	}
+
+	var code, err2 = generate(files, strings.Split(*typeNames, ","), tcputilPath)
+
+	if err2 != nil {
+		return err2
+	}
+
+	return os.WriteFile(outputName, code, 0644)
+}
+
+// 解析目录中除了测试文件和输出文件以外的所有Go源文件
+func parseDir(dir, outputName string) ([]*ast.File, error) {
+	var names, err = filepath.Glob(filepath.Join(dir, "*.go"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		fset  = token.NewFileSet()
+		files []*ast.File
+	)
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") || filepath.Clean(name) == filepath.Clean(outputName) {
+			continue
+		}
+
+		var file, err = parser.ParseFile(fset, name, nil, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+
+	return files, nil
+}
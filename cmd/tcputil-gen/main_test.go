@@ -0,0 +1,338 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSource = `package example
+
+type UserId uint32
+
+type Pos struct {
+	X, Y int16
+}
+
+type Login struct {
+	Id      UserId
+	Flag    byte
+	Online  bool
+	Rate    float32
+	Name    string ` + "`tcputil:\"8\"`" + `
+	Token   []byte ` + "`tcputil:\"32\"`" + `
+	Pos     Pos
+	Path    []Pos
+	Tags    []string ` + "`tcputil:\"8,16\"`" + `
+	Scores  [][]int64
+	private int ` + "`tcputil:\"-\"`" + `
+}
+`
+
+func TestGenerate(t *testing.T) {
+	var fset = token.NewFileSet()
+
+	var file, err1 = parser.ParseFile(fset, "example.go", testSource, 0)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	var code, err2 = generate([]*ast.File{file}, []string{"Pos", "Login"}, "example.com/tcputil")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	for _, expect := range []string{
+		"func (this *Login) Size() int {",
+		"out.WriteUint32(uint32(this.Id))",
+		"this.Id = UserId(in.ReadUint32())",
+		"out.WriteString8(this.Name)",
+		"this.Online = in.ReadBool()",
+		"if len(in.Data) < 4*n",
+	} {
+		if !strings.Contains(string(code), expect) {
+			t.Fatalf("expect %q in generated code:\n%s", expect, code)
+		}
+	}
+
+	if strings.Contains(string(code), "private") {
+		t.Fatalf("skipped field in generated code:\n%s", code)
+	}
+
+	// 连同tcputil的源码一起做类型检查，确保生成的代码可以编译
+	var tcputil = checkTcputil(t, fset)
+
+	var generated, err3 = parser.ParseFile(fset, "example_tcputil.go", code, 0)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	var config = types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			return tcputil, nil
+		}),
+	}
+
+	if _, err := config.Check("example", fset, []*ast.File{file, generated}, nil); err != nil {
+		t.Fatalf("%v\n%s", err, code)
+	}
+
+	if _, err := generate([]*ast.File{file}, []string{"Missing"}, "example.com/tcputil"); err == nil {
+		t.Fatal("expect error for missing type")
+	}
+}
+
+// 覆盖所有支持的字段类型，生成代码以后跟tcputil的源码一起编译运行，检查编码再解码以后是否一致
+const roundTripSource = `package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	"example.com/tcputil"
+)
+
+type Level int16
+
+type Point struct {
+	X, Y int32
+}
+
+type All struct {
+	B       bool
+	I8      int8
+	U8      uint8
+	Byte    byte
+	I16     int16
+	U16     uint16
+	I32     int32
+	U32     uint32
+	I64     int64
+	U64     uint64
+	F32     float32
+	F64     float64
+	Level   Level
+	Str8    string ` + "`tcputil:\"8\"`" + `
+	Str16   string
+	Str32   string ` + "`tcputil:\"32\"`" + `
+	Bytes8  []byte ` + "`tcputil:\"8\"`" + `
+	Bytes16 []byte
+	Bytes32 []byte ` + "`tcputil:\"32\"`" + `
+	Point   Point
+	Points  []Point ` + "`tcputil:\"8\"`" + `
+	Ints    []uint16
+	Strs    []string ` + "`tcputil:\"16,8\"`" + `
+	Blobs   [][]byte ` + "`tcputil:\"32,16\"`" + `
+	Matrix  [][]int64
+	Skip    int ` + "`tcputil:\"-\"`" + `
+}
+
+func main() {
+	var pool, _ = tcputil.NewSyncMemPool(1 << 16)
+	var listener, err1 = net.Listen("tcp", "127.0.0.1:0")
+
+	if err1 != nil {
+		fail(err1)
+	}
+
+	var server, _ = tcputil.NewTcpListener(listener.(*net.TCPListener), 4, 0, pool)
+	var client, err2 = tcputil.Connect(listener.Addr().String(), 4, 0, pool)
+
+	if err2 != nil {
+		fail(err2)
+	}
+
+	var conn, _ = server.Accept()
+
+	var expect = All{
+		B: true, I8: -8, U8: 8, Byte: 'b', I16: -16, U16: 16, I32: -32, U32: 32, I64: -64, U64: 64,
+		F32: 3.5, F64: -2.25, Level: 7,
+		Str8: "eight", Str16: "sixteen", Str32: strings.Repeat("x", 300),
+		Bytes8: []byte{8}, Bytes16: []byte{1, 6}, Bytes32: []byte{3, 2},
+		Point:  Point{1, -1},
+		Points: []Point{{1, 2}, {3, 4}},
+		Ints:   []uint16{1, 2, 3},
+		Strs:   []string{"a", "bc"},
+		Blobs:  [][]byte{{1}, {2, 3}},
+		Matrix: [][]int64{{1}, {2, 3}},
+	}
+
+	if err := expect.MarshalTo(client.NewPackage(expect.Size())).Send(); err != nil {
+		fail(err)
+	}
+
+	var input, err3 = conn.ReadInput()
+
+	if err3 != nil {
+		fail(err3)
+	}
+
+	var actual All
+
+	if err := actual.UnmarshalFrom(input); err != nil || len(input.Data) != 0 {
+		fail(fmt.Errorf("unmarshal: %v, %d bytes left", err, len(input.Data)))
+	}
+
+	if !reflect.DeepEqual(actual, expect) {
+		fail(fmt.Errorf("expect %+v, got %+v", expect, actual))
+	}
+
+	// 长度前缀写不下时不能写出截断的长度
+	for _, bad := range []All{
+		{Str8: strings.Repeat("x", 256)},
+		{Bytes16: make([]byte, 1<<16)},
+		{Points: make([]Point, 256)},
+		{Strs: []string{strings.Repeat("x", 256)}},
+	} {
+		if msg := marshalPanic(&bad); !strings.Contains(msg, "length prefix") {
+			fail(fmt.Errorf("expect overflow panic, got %q", msg))
+		}
+	}
+
+	fmt.Print("ok")
+}
+
+func marshalPanic(msg *All) (result string) {
+	defer func() {
+		result = fmt.Sprint(recover())
+	}()
+
+	var pool, _ = tcputil.NewSyncMemPool(1 << 20)
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var client, _ = tcputil.Connect(listener.Addr().String(), 4, 0, pool)
+
+	defer listener.Close()
+	defer client.Close()
+
+	msg.MarshalTo(client.NewPackage(msg.Size()))
+
+	return ""
+}
+
+func fail(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
+`
+
+func TestRoundTrip(t *testing.T) {
+	var goTool, err1 = exec.LookPath("go")
+
+	if err1 != nil {
+		t.Skip("go command not found")
+	}
+
+	var fset = token.NewFileSet()
+
+	var file, err2 = parser.ParseFile(fset, "example.go", roundTripSource, 0)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	var code, err3 = generate([]*ast.File{file}, []string{"Point", "All"}, "example.com/tcputil")
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	// 复制tcputil的源码作为一个独立的模块，示例程序通过replace引用它
+	var (
+		dir     = t.TempDir()
+		libDir  = filepath.Join(dir, "tcputil")
+		mainDir = filepath.Join(dir, "example")
+		names   []string
+	)
+
+	names, _ = filepath.Glob("../../*.go")
+
+	writeFile(t, filepath.Join(libDir, "go.mod"), "module example.com/tcputil\n\ngo 1.21\n")
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		var data, err = os.ReadFile(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, filepath.Join(libDir, filepath.Base(name)), string(data))
+	}
+
+	writeFile(t, filepath.Join(mainDir, "go.mod"), "module example\n\ngo 1.21\n\nrequire example.com/tcputil v0.0.0\n\nreplace example.com/tcputil => ../tcputil\n")
+	writeFile(t, filepath.Join(mainDir, "example.go"), roundTripSource)
+	writeFile(t, filepath.Join(mainDir, "example_tcputil.go"), string(code))
+
+	var cmd = exec.Command(goTool, "run", ".")
+
+	cmd.Dir = mainDir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+
+	if output, err := cmd.CombinedOutput(); err != nil || string(output) != "ok" {
+		t.Fatalf("%v: %s\n%s", err, output, code)
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+func checkTcputil(t *testing.T, fset *token.FileSet) *types.Package {
+	var names, _ = filepath.Glob("../../*.go")
+	var files []*ast.File
+
+	for _, name := range names {
+		if match, _ := build.Default.MatchFile(filepath.Dir(name), filepath.Base(name)); !match || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		var file, err = parser.ParseFile(fset, name, nil, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, file)
+	}
+
+	var config = types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+	}
+
+	var pkg, err = config.Check("example.com/tcputil", fset, files, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pkg
+}
@@ -0,0 +1,7 @@
+//
+// tcputil是一个面向包协议的TCP网络库，同时内置了一套网关，请参考'NewTcpGatewayFrontend'和'NewTcpGatewayBackend'。
+//
+// 网关前端、网关后端和客户端之间的协议跟早期版本不兼容：转发的每个消息包都带有网关命令字节，网关前端在连接建立时发送内存池限制，网关后端回复连接序号的位数，
+// 'ConnectGateway'会等待网关前端回复握手结果。升级时网关前端、网关后端和连接网关的客户端必须一起升级，不能混用新旧版本。
+//
+package tcputil
@@ -0,0 +1,99 @@
+package tcputil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+var (
+	// 消息包长度超过了内存池允许分配的最大长度
+	ErrPacketTooLarge = errors.New("tcputil: packet too large")
+
+	// 消息包长度不符合分帧规则，例如使用固定长度分帧时发送了长度不一致的消息包
+	ErrFrameSize = errors.New("tcputil: bad frame size")
+
+	// 消息包数据不完整，由安全模式下的TcpInput以及tcputil-gen生成的UnmarshalFrom方法返回
+	ErrInputTooShort = errors.New("tcputil: input too short")
+
+	// 连接已经关闭，或者对方在两个消息包之间正常断开了连接
+	ErrConnClosed = errors.New("tcputil: connection closed")
+
+	// 连接在消息包传输到一半时断开，只收到了不完整的消息包
+	ErrShortRead = errors.New("tcputil: short read")
+
+	// 监听器已经关闭
+	ErrListenerClosed = errors.New("tcputil: listener closed")
+
+	// 发送队列已满，消息包被丢弃，只在使用TcpSendDropNewest策略时产生
+	ErrSendQueueFull = errors.New("tcputil: send queue full")
+
+	// 发送队列已满，对方接收太慢，连接已被断开，只在使用TcpSendCloseSlow策略时产生
+	ErrSlowConsumer = errors.New("tcputil: slow consumer")
+
+	// 超过'WithIdleTimeout'设置的时间没有收到新的消息包，连接已被断开
+	ErrIdleTimeout = errors.New("tcputil: idle timeout")
+
+	// 超过'WithReadTimeout'设置的时间没有读取到完整的消息包，连接已被断开
+	ErrReadTimeout = errors.New("tcputil: read timeout")
+
+	// 超过'WithWriteTimeout'设置的时间没有写完消息包，连接已被断开
+	ErrWriteTimeout = errors.New("tcputil: write timeout")
+
+	// 客户端连上网关以后超过'WithHandshakeTimeout'设置的时间没有发送后端ID，连接已被断开
+	ErrHandshakeTimeout = errors.New("tcputil: handshake timeout")
+
+	// 网关之间超过'WithHeartbeat'设置的时间没有收到对方的任何消息包，连接已被断开
+	ErrHeartbeatTimeout = errors.New("tcputil: heartbeat timeout")
+
+	// 网关已经通过'Close'关闭
+	ErrGatewayClosed = errors.New("tcputil: gateway closed")
+
+	// 网关已经通过'Shutdown'关闭
+	ErrGatewayShutdown = errors.New("tcputil: gateway shutdown")
+
+	// 网关前端没有配置客户端请求的后端ID
+	ErrGatewayUnknownBackend = errors.New("tcputil: gateway unknown backend")
+
+	// 客户端请求的后端已配置，但是网关前端到它的连接暂时不可用
+	ErrGatewayBackendUnavailable = errors.New("tcputil: gateway backend unavailable")
+
+	// 网关前端回复的握手结果无法识别
+	ErrGatewayBadHandshake = errors.New("tcputil: gateway bad handshake")
+)
+
+// 把读取消息包头部时的底层错误转换成对外的错误
+func headReadError(err error) error {
+	switch {
+	case err == io.EOF, errors.Is(err, net.ErrClosed):
+		return ErrConnClosed
+	case err == io.ErrUnexpectedEOF:
+		return ErrShortRead
+	}
+
+	return err
+}
+
+// 把读取消息包内容时的底层错误转换成对外的错误，这时候连接断开都意味着消息包不完整
+func bodyReadError(err error) error {
+	switch {
+	case err == io.EOF, err == io.ErrUnexpectedEOF:
+		return ErrShortRead
+	case errors.Is(err, net.ErrClosed):
+		return ErrConnClosed
+	}
+
+	return err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// 判断Accept时发生的错误是否只是暂时的，例如文件句柄耗尽，或者连接还没取出就被对方断开，这类错误等待一会儿再重试就可以
+func isTemporary(err error) bool {
+	return isTimeout(err) || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED)
+}
@@ -0,0 +1,398 @@
+package tcputil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	_READ_BUFFER_SIZE_ = 4096
+)
+
+//
+// 分帧方式，决定怎样从TCP/IP网络流中分割出一个个独立的消息包，以及发送时怎样给消息包加上头部和尾部。
+// 通过'WithFramer'设置，默认使用'pack'字节长度的头部，请参考'NewTcpHeadFramer'。
+// 实现必须是协程安全的，因为同一个分帧方式通常会被很多连接同时使用。
+//
+type TcpFramer interface {
+	// 消息内容长度为'size'时，帧头部和尾部的长度，消息内容长度不符合分帧规则时返回错误
+	FrameSize(size int) (head, tail int, err error)
+
+	// 在'frame'中写入帧头部和尾部，'frame'的长度是'FrameSize'返回的head+size+tail，中间的消息内容由调用者填写
+	EncodeFrame(frame []byte, size int)
+
+	// 从'reader'读取一帧，返回的内存从'memPool'申请，前面预留'padding'字节，之后是去掉头部和尾部的消息内容
+	// 出错时要把已经申请的内存还给内存池，消息包超过内存池允许的长度时返回ErrPacketTooLarge
+	ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error)
+}
+
+// 把内存还给内存池，只有内存池实现了'RecyclableMemPool'接口时才有效果
+func freeBuff(memPool MemPool, buff []byte) {
+	if buff == nil {
+		return
+	}
+
+	if pool, ok := memPool.(RecyclableMemPool); ok {
+		pool.Free(buff)
+	}
+}
+
+// 申请一块内存并从'reader'读满'padding'之后的部分
+func readFrameBody(reader *bufio.Reader, memPool MemPool, padding, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, ErrPacketTooLarge
+	}
+
+	var buff = memPool.Alloc(padding + size)
+
+	if buff == nil {
+		return nil, ErrPacketTooLarge
+	}
+
+	if _, err := io.ReadFull(reader, buff[padding:]); err != nil {
+		freeBuff(memPool, buff)
+		return nil, err
+	}
+
+	return buff, nil
+}
+
+type tcpHeadFramer struct {
+	pack  int
+	order binary.ByteOrder
+}
+
+//
+// 创建一个在消息包头部存放固定字节数长度信息的分帧方式，类似Erlang的{pack: N}，这是tcputil默认的分帧方式。
+// 参数'pack'必须是1, 2, 4或者8，参数'order'是长度信息的字节序，传入nil表示小端格式。
+//
+func NewTcpHeadFramer(pack int, order binary.ByteOrder) (TcpFramer, error) {
+	if pack != 1 && pack != 2 && pack != 4 && pack != 8 {
+		return nil, errors.New("pack != 1 && pack != 2 && pack != 4 && pack != 8")
+	}
+
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	return &tcpHeadFramer{pack, order}, nil
+}
+
+func (this *tcpHeadFramer) FrameSize(size int) (int, int, error) {
+	if this.pack < 8 && uint64(size) >= 1<<(8*uint(this.pack)) {
+		return 0, 0, ErrPacketTooLarge
+	}
+
+	return this.pack, 0, nil
+}
+
+func (this *tcpHeadFramer) EncodeFrame(frame []byte, size int) {
+	setUint(frame, this.pack, size, this.order)
+}
+
+func (this *tcpHeadFramer) ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error) {
+	var head, err = reader.Peek(this.pack)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var size = getUint(head, this.pack, this.order)
+
+	reader.Discard(this.pack)
+
+	return readFrameBody(reader, memPool, padding, size)
+}
+
+type tcpVarintFramer struct{}
+
+//
+// 创建一个用protobuf风格的varint在消息包头部存放长度信息的分帧方式，小消息包只需要一个字节的头部。
+//
+func NewTcpVarintFramer() TcpFramer {
+	return tcpVarintFramer{}
+}
+
+func (tcpVarintFramer) FrameSize(size int) (int, int, error) {
+	return UvarintSize(uint64(size)), 0, nil
+}
+
+func (tcpVarintFramer) EncodeFrame(frame []byte, size int) {
+	binary.PutUvarint(frame, uint64(size))
+}
+
+func (tcpVarintFramer) ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error) {
+	var size, err = binary.ReadUvarint(reader)
+
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		// 超过64位的varint
+		return nil, ErrPacketTooLarge
+	}
+
+	if size > uint64(^uint(0)>>1) {
+		return nil, ErrPacketTooLarge
+	}
+
+	return readFrameBody(reader, memPool, padding, int(size))
+}
+
+type tcpDelimiterFramer struct {
+	delimiter []byte
+	maxLength int
+}
+
+//
+// 创建一个以分隔符结尾的分帧方式，例如按行分割的文本协议，读取到的消息包不包含分隔符，发送时会自动在消息内容后面加上分隔符。
+// 参数'maxLength'用于限制消息内容的最大长度，超过这个长度还没遇到分隔符时返回ErrPacketTooLarge。
+// 消息内容中不能出现分隔符，tcputil不会对消息内容做转义。
+//
+func NewTcpDelimiterFramer(delimiter []byte, maxLength int) (TcpFramer, error) {
+	if len(delimiter) == 0 {
+		return nil, errors.New("len(delimiter) == 0")
+	}
+
+	if maxLength <= 0 {
+		return nil, errors.New("maxLength <= 0")
+	}
+
+	return &tcpDelimiterFramer{append([]byte(nil), delimiter...), maxLength}, nil
+}
+
+func (this *tcpDelimiterFramer) FrameSize(size int) (int, int, error) {
+	if size > this.maxLength {
+		return 0, 0, ErrPacketTooLarge
+	}
+
+	return 0, len(this.delimiter), nil
+}
+
+func (this *tcpDelimiterFramer) EncodeFrame(frame []byte, size int) {
+	copy(frame[size:], this.delimiter)
+}
+
+func (this *tcpDelimiterFramer) ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error) {
+	var (
+		last  = this.delimiter[len(this.delimiter)-1]
+		limit = this.maxLength + len(this.delimiter)
+		line  []byte
+	)
+
+	for {
+		var chunk, err = reader.ReadSlice(last)
+
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+
+		if len(line)+len(chunk) > limit {
+			return nil, ErrPacketTooLarge
+		}
+
+		// 整帧都在读缓冲区里的时候直接复制，不需要额外的内存
+		if err == nil && line == nil && bytes.HasSuffix(chunk, this.delimiter) {
+			return this.copyFrame(chunk, memPool, padding)
+		}
+
+		line = append(line, chunk...)
+
+		if err == nil && bytes.HasSuffix(line, this.delimiter) {
+			return this.copyFrame(line, memPool, padding)
+		}
+	}
+}
+
+func (this *tcpDelimiterFramer) copyFrame(line []byte, memPool MemPool, padding int) ([]byte, error) {
+	var msg = line[:len(line)-len(this.delimiter)]
+	var buff = memPool.Alloc(padding + len(msg))
+
+	if buff == nil {
+		return nil, ErrPacketTooLarge
+	}
+
+	copy(buff[padding:], msg)
+
+	return buff, nil
+}
+
+type tcpFixedFramer struct {
+	length int
+}
+
+//
+// 创建一个固定长度的分帧方式，每个消息包都是'length'字节，没有头部和尾部。
+// 发送长度不一致的消息包时，'NewPackage'会返回nil。
+//
+func NewTcpFixedFramer(length int) (TcpFramer, error) {
+	if length <= 0 {
+		return nil, errors.New("length <= 0")
+	}
+
+	return &tcpFixedFramer{length}, nil
+}
+
+func (this *tcpFixedFramer) FrameSize(size int) (int, int, error) {
+	if size != this.length {
+		return 0, 0, ErrFrameSize
+	}
+
+	return 0, 0, nil
+}
+
+func (this *tcpFixedFramer) EncodeFrame(frame []byte, size int) {
+}
+
+func (this *tcpFixedFramer) ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error) {
+	return readFrameBody(reader, memPool, padding, this.length)
+}
+
+//
+// 长度信息的位置和含义，用于'NewTcpLengthFieldFramer'，跟Netty的LengthFieldBasedFrameDecoder类似。
+// 一帧的总长度是：长度信息的值 + LengthAdjustment + LengthFieldOffset + LengthFieldLength。
+//
+type TcpLengthField struct {
+	LengthFieldOffset   int              // 长度信息在帧中的偏移，前面通常是魔数之类的固定内容
+	LengthFieldLength   int              // 长度信息的字节数，必须是1, 2, 4或者8
+	LengthAdjustment    int              // 长度信息的值的修正，例如长度信息包含了整个头部时设置成负的头部长度
+	InitialBytesToStrip int              // 读取时从帧开头去掉的字节数，通常就是头部长度
+	Prefix              []byte           // 发送时写在长度信息前面的内容，长度必须等于LengthFieldOffset，nil表示全部填0
+	Order               binary.ByteOrder // 长度信息的字节序，nil表示小端格式
+}
+
+type tcpLengthFieldFramer struct {
+	offset     int
+	length     int
+	adjustment int
+	strip      int
+	prefix     []byte
+	order      binary.ByteOrder
+}
+
+//
+// 创建一个长度信息不一定在帧开头，并且长度信息的值不一定等于消息内容长度的分帧方式，用于对接已有的私有协议。
+// 读取时返回去掉'InitialBytesToStrip'字节以后的内容，所以没有去掉的头部也会出现在消息内容中。
+// 发送时'NewPackage'的'size'参数是头部之后的消息内容长度，头部由分帧方式负责写入，头部长度取长度信息结束位置和'InitialBytesToStrip'中大的那个。
+//
+func NewTcpLengthFieldFramer(field TcpLengthField) (TcpFramer, error) {
+	if field.LengthFieldOffset < 0 || field.LengthFieldOffset+field.LengthFieldLength > _READ_BUFFER_SIZE_ {
+		return nil, errors.New("bad LengthFieldOffset")
+	}
+
+	if field.LengthFieldLength != 1 && field.LengthFieldLength != 2 && field.LengthFieldLength != 4 && field.LengthFieldLength != 8 {
+		return nil, errors.New("LengthFieldLength != 1 && LengthFieldLength != 2 && LengthFieldLength != 4 && LengthFieldLength != 8")
+	}
+
+	if field.InitialBytesToStrip < 0 {
+		return nil, errors.New("InitialBytesToStrip < 0")
+	}
+
+	if field.Prefix != nil && len(field.Prefix) != field.LengthFieldOffset {
+		return nil, errors.New("len(Prefix) != LengthFieldOffset")
+	}
+
+	if field.Order == nil {
+		field.Order = binary.LittleEndian
+	}
+
+	return &tcpLengthFieldFramer{
+		offset:     field.LengthFieldOffset,
+		length:     field.LengthFieldLength,
+		adjustment: field.LengthAdjustment,
+		strip:      field.InitialBytesToStrip,
+		prefix:     append([]byte(nil), field.Prefix...),
+		order:      field.Order,
+	}, nil
+}
+
+// 长度信息结束的位置
+func (this *tcpLengthFieldFramer) end() int {
+	return this.offset + this.length
+}
+
+// 发送时的头部长度
+func (this *tcpLengthFieldFramer) head() int {
+	if this.strip > this.end() {
+		return this.strip
+	}
+
+	return this.end()
+}
+
+func (this *tcpLengthFieldFramer) FrameSize(size int) (int, int, error) {
+	var head = this.head()
+	var value = head + size - this.end() - this.adjustment
+
+	if value < 0 {
+		return 0, 0, ErrFrameSize
+	}
+
+	if this.length < 8 && uint64(value) >= 1<<(8*uint(this.length)) {
+		return 0, 0, ErrPacketTooLarge
+	}
+
+	return head, 0, nil
+}
+
+func (this *tcpLengthFieldFramer) EncodeFrame(frame []byte, size int) {
+	var head = this.head()
+
+	// 内存池返回的内存不一定是干净的
+	clear(frame[:head])
+
+	copy(frame, this.prefix)
+
+	setUint(frame[this.offset:], this.length, head+size-this.end()-this.adjustment, this.order)
+}
+
+func (this *tcpLengthFieldFramer) ReadFrame(reader *bufio.Reader, memPool MemPool, padding int) ([]byte, error) {
+	var end = this.end()
+	var head, err = reader.Peek(end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var value = getUint(head[this.offset:], this.length, this.order)
+
+	if value < 0 || value > math.MaxInt32 {
+		return nil, ErrPacketTooLarge
+	}
+
+	var frame = value + this.adjustment + end
+
+	if frame < end || frame < this.strip {
+		return nil, ErrFrameSize
+	}
+
+	if this.strip > end {
+		if _, err := reader.Discard(this.strip); err != nil {
+			return nil, err
+		}
+
+		return readFrameBody(reader, memPool, padding, frame-this.strip)
+	}
+
+	// 没有去掉的头部已经在读缓冲区里，先复制出来
+	var buff = memPool.Alloc(padding + frame - this.strip)
+
+	if buff == nil {
+		return nil, ErrPacketTooLarge
+	}
+
+	var n = copy(buff[padding:], head[this.strip:])
+
+	reader.Discard(end)
+
+	if _, err := io.ReadFull(reader, buff[padding+n:]); err != nil {
+		freeBuff(memPool, buff)
+		return nil, err
+	}
+
+	return buff, nil
+}
@@ -1,11 +1,16 @@
 package tcputil
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"time"
 )
 
 const (
-	_GATEWAY_MAX_LINKS_ = 256
+	_GATEWAY_LINK_BITS_     = 8 // 默认的网关前端连接序号位数，最多256个网关前端连接
+	_GATEWAY_MIN_LINK_BITS_ = 1
+	_GATEWAY_MAX_LINK_BITS_ = 16
 )
 
 //
@@ -13,8 +18,18 @@ const (
 //
 type TcpGatewayBackend struct {
 	server     *TcpListener
+	framer     TcpFramer
 	links      []*TcpConn
+	linkLimits []int // 网关前端读取网关命令时内存池允许的最大长度，0表示不知道，由linksMutex保护
 	linksMutex sync.RWMutex
+	linksWait  sync.WaitGroup
+	done       chan struct{}
+	err        error
+	errMutex   sync.Mutex
+	sessions   *tcpGatewaySessions
+	linkBits   int
+	clientBits uint // 客户端ID中属于客户端自己的低位位数，高位是网关前端连接序号
+	safeInput  bool // 交给'messageHeandler'的消息是否使用安全模式，网关之间的连接本身不使用
 }
 
 //
@@ -23,58 +38,178 @@ type TcpGatewayBackend struct {
 type TcpGatewayIntput struct {
 	ClientId uint32
 	*TcpInput
+
+	backend    *TcpGatewayBackend
+	clientAddr bool // 开启TakeClientAddr时客户端接入后的地址消息，不是客户端发送的
 }
 
 //
 // 在指定的地址和端口创建一个网关后端，等待网关前端连接。
 // 一个网关后端可以被多个网关前端连接，客户端ID分配算法会保证不同网关前端的客户端ID不冲突。
+// 网关后端关闭，并且所有网关前端的连接都断开以后，'messageHeandler'会收到一个nil，关闭的原因可以通过'Err'方法获取。
+// 客户端断开时'messageHeandler'会收到一个内容为空的消息，需要明确区分客户端接入和断开的请使用'NewTcpGatewaySessionBackend'。
+// 参数'opts'中的'WithFramer'决定发给客户端的消息包怎样分帧，需要跟网关前端的设置一致，网关前端和网关后端之间仍然使用'pack'字节长度的头部。
 //
-func NewTcpGatewayBackend(addr string, pack int, memPool MemPool, messageHeandler func(msg *TcpGatewayIntput)) (*TcpGatewayBackend, error) {
-	var server, err = Listen(addr, pack, 0, memPool)
+func NewTcpGatewayBackend(addr string, pack int, memPool MemPool, messageHeandler func(msg *TcpGatewayIntput), opts ...TcpOption) (*TcpGatewayBackend, error) {
+	return newTcpGatewayBackend(addr, pack, memPool, messageHeandler, nil, opts)
+}
 
-	if err != nil {
-		return nil, err
+func newTcpGatewayBackend(addr string, pack int, memPool MemPool, messageHeandler func(msg *TcpGatewayIntput), sessions *tcpGatewaySessions, opts []TcpOption) (*TcpGatewayBackend, error) {
+	var config = newTcpConfig(opts)
+
+	var framer, err1 = config.newFramer(pack)
+
+	if err1 != nil {
+		return nil, err1
+	}
+
+	var server, err2 = listenTcp(context.Background(), addr, config.linkConfig(), pack, 0, memPool)
+
+	if err2 != nil {
+		return nil, err2
 	}
 
 	var this = &TcpGatewayBackend{
-		server: server,
-		links:  make([]*TcpConn, _GATEWAY_MAX_LINKS_),
+		server:     server,
+		framer:     framer,
+		links:      make([]*TcpConn, 1<<config.linkBits),
+		linkLimits: make([]int, 1<<config.linkBits),
+		done:       make(chan struct{}),
+		sessions:   sessions,
+		linkBits:   config.linkBits,
+		clientBits: uint(32 - config.linkBits),
+		safeInput:  config.safeInput,
 	}
 
-	go func() {
-		for {
-			var link = this.server.Accpet()
+	if sessions != nil {
+		sessions.backend = this
+	}
 
-			if link == nil {
-				break
-			}
+	go func() {
+		this.server.acceptLoop(func(link *TcpConn) {
+			this.linksWait.Add(1)
 
 			go func() {
 				defer func() {
 					link.Close()
+					this.linksWait.Done()
 				}()
 
-				var linkId = this.addLink(link)
+				// [max packet size](4)
+				var limitMsg, err = link.readPacket(this.server.config.handshakeTimeout, ErrHandshakeTimeout, true)
+
+				if err != nil || len(limitMsg) != 4 {
+					return
+				}
+
+				var linkId = this.addLink(link, int(link.order.Uint32(limitMsg)))
+
+				link.Free(limitMsg)
 
 				if linkId < 0 {
 					return
 				}
 
+				var linkAddr = link.conn.RemoteAddr().String()
+				var linkErr error
+
 				defer func() {
+					// 先结束这个连接上的会话再释放连接序号，否则重连的网关前端拿到同一个序号以后，新会话会被当作旧连接的会话结束
+					if this.sessions != nil {
+						this.sessions.linkClosed(uint32(linkId), linkErr)
+					}
+
 					this.delLink(linkId)
+
+					this.server.config.emitLinkEvent(uint32(linkId), linkAddr, false, linkErr)
 				}()
 
+				this.server.config.emitLinkEvent(uint32(linkId), linkAddr, true, nil)
+
+				go heartbeatLoop(link, this.server.config.heartbeatInterval)
+
 				for {
-					var msg = link.ReadPackage()
+					var buff []byte
 
-					if msg == nil {
+					if buff, linkErr = readLinkPacket(link, this.server.config.heartbeatTimeout()); linkErr != nil {
 						break
 					}
 
-					messageHeandler(&TcpGatewayIntput{msg.ReadUint32(), msg})
+					var msg = NewTcpInputWithOrder(buff, link.order).Safe()
+
+					switch msg.ReadUint8() {
+					case _GATEWAY_COMMAND_NONE_:
+						var clientId = msg.ReadUint32()
+
+						if msg.Err() != nil {
+							link.Free(buff)
+							break
+						}
+
+						msg.safe = this.safeInput
+
+						messageHeandler(&TcpGatewayIntput{clientId, msg, this, false})
+					case _GATEWAY_COMMAND_ADD_CLIENT_:
+						var (
+							clientId    = msg.ReadUint32()
+							frontendId  = msg.ReadUint32()
+							connectTime = msg.ReadInt64()
+							addr        = msg.PeekString8()
+						)
+
+						if msg.Err() != nil {
+							link.Free(buff)
+							break
+						}
+
+						if this.sessions != nil {
+							this.sessions.add(&TcpGatewaySession{
+								backend:     this,
+								id:          clientId,
+								frontendId:  frontendId,
+								connectTime: time.Unix(0, connectTime),
+								addr:        addr,
+							})
+							link.Free(buff)
+						} else if addr != "" {
+							// 兼容以前的用法，开启了TakeClientAddr时客户端地址作为第一个消息包交给'messageHeandler'
+							msg.safe = this.safeInput
+
+							messageHeandler(&TcpGatewayIntput{clientId, msg, this, true})
+						} else {
+							link.Free(buff)
+						}
+					case _GATEWAY_COMMAND_DEL_CLIENT_:
+						var clientId = msg.ReadUint32()
+
+						if msg.Err() != nil {
+							link.Free(buff)
+							break
+						}
+
+						if this.sessions != nil {
+							this.sessions.remove(clientId, ErrConnClosed)
+							link.Free(buff)
+						} else {
+							// 兼容以前的用法，用空消息通知客户端断开
+							messageHeandler(&TcpGatewayIntput{clientId, msg, this, false})
+						}
+					case _GATEWAY_COMMAND_PING_:
+						sendLinkCommand(link, _GATEWAY_COMMAND_PONG_)
+						link.Free(buff)
+					case _GATEWAY_COMMAND_DRAIN_:
+						// 网关前端正在排空，不需要特别处理，它会在客户端全部断开后主动断开连接
+						link.Free(buff)
+					default:
+						link.Free(buff)
+					}
 				}
 			}()
-		}
+		})
+
+		this.linksWait.Wait()
+
+		close(this.done)
 
 		messageHeandler(nil)
 	}()
@@ -82,21 +217,21 @@ func NewTcpGatewayBackend(addr string, pack int, memPool MemPool, messageHeandle
 	return this, nil
 }
 
-func (this *TcpGatewayBackend) addLink(link *TcpConn) int {
+func (this *TcpGatewayBackend) addLink(link *TcpConn, limit int) int {
 	this.linksMutex.Lock()
 	defer this.linksMutex.Unlock()
 
 	for id := 0; id < len(this.links); id++ {
 		if this.links[id] == nil {
-			var serverIdMsg = link.NewPackage(4)
+			// [begin client id](4) + [link bits](1)
+			var serverIdMsg = link.NewPackage(4 + 1)
 
-			serverIdMsg.WriteUint32(uint32(id) << 24)
-
-			if err := serverIdMsg.Send(); err != nil {
+			if serverIdMsg == nil || serverIdMsg.WriteUint32(uint32(id)<<this.clientBits).WriteUint8(uint8(this.linkBits)).Send() != nil {
 				return -1
 			}
 
 			this.links[id] = link
+			this.linkLimits[id] = limit
 
 			return id
 		}
@@ -116,13 +251,20 @@ func (this *TcpGatewayBackend) getLink(clientId uint32) *TcpConn {
 	this.linksMutex.RLock()
 	defer this.linksMutex.RUnlock()
 
-	return this.links[int(clientId>>24)]
+	return this.links[this.linkId(clientId)]
+}
+
+// 客户端ID所在的网关前端连接序号
+func (this *TcpGatewayBackend) linkId(clientId uint32) int {
+	return int(clientId >> this.clientBits)
 }
 
 //
 // 你懂的。
 //
 func (this *TcpGatewayBackend) Close() {
+	this.setErr(ErrGatewayClosed)
+
 	this.linksMutex.Lock()
 	defer this.linksMutex.Unlock()
 
@@ -136,7 +278,55 @@ func (this *TcpGatewayBackend) Close() {
 }
 
 //
-// 创建一个发送给指定客户端的消息包
+// 优雅的关闭网关后端，不再接受新的网关前端，通知所有网关前端这个后端正在排空。
+// 网关前端收到通知后不再分配新的客户端过来，等现有客户端全部断开后主动断开连接。
+// 所有连接都断开后返回nil，如果'ctx'先结束，就直接关闭剩下的连接，发送队列中的消息包仍然会尽量写完，这时返回ctx.Err()。
+//
+func (this *TcpGatewayBackend) Shutdown(ctx context.Context) error {
+	this.setErr(ErrGatewayShutdown)
+
+	this.linksMutex.RLock()
+
+	this.server.Close()
+
+	for _, link := range this.links {
+		if link != nil {
+			sendLinkCommand(link, _GATEWAY_COMMAND_DRAIN_)
+		}
+	}
+
+	this.linksMutex.RUnlock()
+
+	select {
+	case <-this.done:
+		return nil
+	case <-ctx.Done():
+		this.Close()
+		return ctx.Err()
+	}
+}
+
+//
+// 返回网关后端关闭的原因，调用'Close'关闭时返回ErrGatewayClosed，调用'Shutdown'关闭时返回ErrGatewayShutdown，还没关闭时返回nil。
+//
+func (this *TcpGatewayBackend) Err() error {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+
+	return this.err
+}
+
+func (this *TcpGatewayBackend) setErr(err error) {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+
+	if this.err == nil {
+		this.err = err
+	}
+}
+
+//
+// 创建一个发送给指定客户端的消息包，消息包超过内存池允许的长度，或者长度不符合分帧规则时返回nil。
 //
 func (this *TcpGatewayBackend) NewPackage(clientId uint32, size int) *TcpOutput {
 	var link = this.getLink(clientId)
@@ -145,8 +335,31 @@ func (this *TcpGatewayBackend) NewPackage(clientId uint32, size int) *TcpOutput
 		return nil
 	}
 
-	// [gateway command](1) + [client id](4) + [real package size](pack) + [real package content](return)
-	return link.NewPackage(1+4+link.pack+size).WriteUint8(_GATEWAY_COMMAND_NONE_).WriteUint32(clientId).WriteUint(link.pack, uint64(size))
+	var head, tail, err = this.framer.FrameSize(size)
+
+	if err != nil {
+		return nil
+	}
+
+	// [gateway command](1) + [client id](4) + [real package head](head) + [real package content](return) + [real package tail](tail)
+	var output = link.NewPackage(1 + 4 + head + size + tail)
+
+	if output == nil {
+		return nil
+	}
+
+	output.WriteUint8(_GATEWAY_COMMAND_NONE_).WriteUint32(clientId)
+
+	return this.encodeFrame(output, head, size)
+}
+
+// 在消息包剩余的部分写入发给客户端的帧头部和尾部，只留下消息内容给调用者填写
+func (this *TcpGatewayBackend) encodeFrame(output *TcpOutput, head, size int) *TcpOutput {
+	this.framer.EncodeFrame(output.Data, size)
+
+	output.Data = output.Data[head : head+size]
+
+	return output
 }
 
 //
@@ -160,65 +373,281 @@ func (this *TcpGatewayBackend) DelClient(clientId uint32) {
 	}
 
 	// [gateway command](1) + [client id](4)
-	link.NewPackage(1 + 4).WriteUint8(_GATEWAY_COMMAND_DEL_CLIENT_).WriteUint32(clientId).Send()
+	var output = link.NewPackage(1 + 4)
+
+	// 申请不到内存时没法通知网关前端，断开整个连接，上面的客户端都会被断开
+	if output == nil {
+		link.expire(ErrPacketTooLarge)
+		return
+	}
+
+	output.WriteUint8(_GATEWAY_COMMAND_DEL_CLIENT_).WriteUint32(clientId).Send()
 }
 
 //
-// 创建一个发送给指定客户端的广播包，广播包的用法跟'TcpOutput'包一样
+// 创建一个发送给指定客户端的广播包，广播包的用法跟'TcpOutput'包一样。
+// 客户端ID按所在的网关前端分组，每个网关前端只收到自己的客户端ID，消息内容只编码一次，由所有网关前端共享。
+// 一个网关前端的客户端ID超过65535个，或者广播命令超过分帧规则和网关前端内存池允许的长度时，会拆成多个广播命令发送，客户端数量没有限制。
+// 消息内容太大，连一个客户端ID都放不下时，'Send'不会发给这个网关前端，并返回ErrPacketTooLarge。
 //
 func (this *TcpGatewayBackend) NewBroadcast(clientIds []uint32, size int) *TcpBroadcast {
-	var link *TcpConn
-
-	// find first usable link
-	for i := 0; i < len(clientIds); i++ {
-		link = this.getLink(clientIds[i])
+	var (
+		link   *TcpConn
+		groups = make(map[uint32][]uint32)
+	)
 
-		if link != nil {
-			break
+	for _, clientId := range clientIds {
+		if link == nil {
+			link = this.getLink(clientId)
 		}
+
+		var linkId = uint32(this.linkId(clientId))
+
+		groups[linkId] = append(groups[linkId], clientId)
 	}
 
 	if link == nil {
 		return nil
 	}
 
-	// [gateway command](1) + [client id list length](2) + [client id list](4 x len) + [real pack size](pack) + [real package content](return)
-	var (
-		output = link.NewPackage(1 + 2 + 4*len(clientIds) + link.pack + size)
-		idNum  = len(clientIds)
-	)
+	return this.newBroadcast(link, &TcpBroadcast{owner: this, command: _GATEWAY_COMMAND_BROADCAST_, groups: groups}, size)
+}
 
-	output.WriteUint8(_GATEWAY_COMMAND_BROADCAST_).WriteUint16(uint16(idNum))
+//
+// 创建一个发送给所有客户端的广播包，不需要列出客户端ID，每个网关前端只收到一个广播命令，由网关前端转发给它的所有客户端。
+// 没有任何网关前端连接时返回nil。
+//
+func (this *TcpGatewayBackend) NewBroadcastAll(size int) *TcpBroadcast {
+	var link = this.anyLink()
 
-	for i := 0; i < idNum; i++ {
-		output.WriteUint32(clientIds[i])
+	if link == nil {
+		return nil
 	}
 
-	output.WriteUint(link.pack, uint64(size))
+	return this.newBroadcast(link, &TcpBroadcast{owner: this, command: _GATEWAY_COMMAND_BROADCAST_ALL_}, size)
+}
+
+//
+// 创建一个发送给分组中所有客户端的广播包，分组成员由网关前端维护，广播命令只携带分组ID，请参考'JoinGroup'。
+// 没有任何网关前端连接时返回nil。
+//
+func (this *TcpGatewayBackend) NewGroupBroadcast(groupId uint32, size int) *TcpBroadcast {
+	var link = this.anyLink()
+
+	if link == nil {
+		return nil
+	}
 
-	return &TcpBroadcast{this, output}
+	return this.newBroadcast(link, &TcpBroadcast{owner: this, command: _GATEWAY_COMMAND_GROUP_SEND_, groupId: groupId}, size)
+}
+
+//
+// 把客户端加入分组，之后发给这个分组的广播包它都会收到，客户端断开时网关前端会自动把它移出所有分组。
+// 同一个客户端可以加入多个分组，重复加入同一个分组没有效果。
+//
+func (this *TcpGatewayBackend) JoinGroup(groupId, clientId uint32) {
+	this.sendGroupCommand(_GATEWAY_COMMAND_GROUP_JOIN_, groupId, clientId)
+}
+
+//
+// 把客户端移出分组。
+//
+func (this *TcpGatewayBackend) LeaveGroup(groupId, clientId uint32) {
+	this.sendGroupCommand(_GATEWAY_COMMAND_GROUP_LEAVE_, groupId, clientId)
+}
+
+func (this *TcpGatewayBackend) sendGroupCommand(command uint8, groupId, clientId uint32) {
+	var link = this.getLink(clientId)
+
+	if link == nil {
+		return
+	}
+
+	// [gateway command](1) + [group id](4) + [client id](4)
+	var output = link.NewPackage(1 + 4 + 4)
+
+	// 申请不到内存时分组成员就跟后端的预期不一致了，断开整个连接，同'DelClient'
+	if output == nil {
+		link.expire(ErrPacketTooLarge)
+		return
+	}
+
+	output.WriteUint8(command).WriteUint32(groupId).WriteUint32(clientId).Send()
+}
+
+func (this *TcpGatewayBackend) anyLink() *TcpConn {
+	this.linksMutex.RLock()
+	defer this.linksMutex.RUnlock()
+
+	for _, link := range this.links {
+		if link != nil {
+			return link
+		}
+	}
+
+	return nil
+}
+
+func (this *TcpGatewayBackend) newBroadcast(link *TcpConn, broadcast *TcpBroadcast, size int) *TcpBroadcast {
+	var head, tail, err = this.framer.FrameSize(size)
+
+	if err != nil {
+		return nil
+	}
+
+	// [real package head](head) + [real package content](return) + [real package tail](tail)
+	var body = this.server.memPool.Alloc(head + size + tail)
+
+	if body == nil {
+		return nil
+	}
+
+	broadcast.TcpOutput = this.encodeFrame(&TcpOutput{owner: link, buff: body, Data: body, order: link.order, broadcast: broadcast}, head, size)
+
+	return broadcast
 }
 
 //
 // 网关广播实例
 //
 type TcpBroadcast struct {
-	owner *TcpGatewayBackend
+	owner   *TcpGatewayBackend
+	command uint8
+	groups  map[uint32][]uint32 // 按网关前端连接序号分组的客户端ID，只在广播给指定客户端时使用
+	groupId uint32              // 只在广播给分组时使用
 	*TcpOutput
 }
 
+//
+// 把广播包发给目标客户端所在的网关前端，没有目标客户端的网关前端不会收到任何数据，返回最后一个发送错误。
+// 广播给全部客户端或者分组时，每个网关前端都会收到一个广播命令。
+//
 func (this *TcpBroadcast) Send() error {
 	this.owner.linksMutex.RLock()
 	defer this.owner.linksMutex.RUnlock()
 
-	var err error
+	var (
+		err  error
+		body = this.TcpOutput.buff
+	)
 
-	for _, link := range this.owner.links {
-		if link != nil {
-			this.TcpOutput.owner = link
-			err = this.TcpOutput.Send()
+	if this.command != _GATEWAY_COMMAND_BROADCAST_ {
+		for linkId, link := range this.owner.links {
+			if link == nil {
+				continue
+			}
+
+			if e := this.sendHead(link, this.owner.linkLimits[linkId], nil, body); e != nil {
+				err = e
+			}
+		}
+
+		return err
+	}
+
+	for linkId, clientIds := range this.groups {
+		var link = this.owner.links[linkId]
+
+		if link == nil {
+			continue
+		}
+
+		var limit = this.owner.linkLimits[linkId]
+
+		// 整个广播命令帧要同时放得下分帧规则和网关前端内存池的限制，一个客户端ID都放不下时不发送
+		var chunk = sort.Search(_GATEWAY_BROADCAST_MAX_IDS_+1, func(n int) bool {
+			return this.checkSize(link, limit, this.headSize(n), body) != nil
+		}) - 1
+
+		if chunk < 1 {
+			err = ErrPacketTooLarge
+			continue
+		}
+
+		for len(clientIds) > 0 {
+			var n = len(clientIds)
+
+			if n > chunk {
+				n = chunk
+			}
+
+			if e := this.sendHead(link, limit, clientIds[:n], body); e != nil {
+				err = e
+			}
+
+			clientIds = clientIds[n:]
 		}
 	}
 
 	return err
 }
+
+// 广播命令除消息内容以外的长度，'ids'是携带的客户端ID数量，只在广播给指定客户端时有用
+func (this *TcpBroadcast) headSize(ids int) int {
+	switch this.command {
+	case _GATEWAY_COMMAND_BROADCAST_:
+		// [gateway command](1) + [client id list length](2) + [client id list](4 x len)
+		return 1 + 2 + 4*ids
+	case _GATEWAY_COMMAND_GROUP_SEND_:
+		// [gateway command](1) + [group id](4)
+		return 1 + 4
+	default:
+		// [gateway command](1)
+		return 1
+	}
+}
+
+// 检查广播命令的长度：整个帧要符合分帧规则，并且不超过网关前端读取时的内存池限制'limit'，单独申请的头部不超过本地内存池的限制
+func (this *TcpBroadcast) checkSize(link *TcpConn, limit, size int, body []byte) error {
+	var head, _, err = link.framer.FrameSize(size + len(body))
+
+	if err != nil {
+		return err
+	}
+
+	if limit > 0 && size+len(body) > limit {
+		return ErrPacketTooLarge
+	}
+
+	if poolMax := memPoolMaxSize(link.memPool); poolMax > 0 && head+size > poolMax {
+		return ErrPacketTooLarge
+	}
+
+	return nil
+}
+
+// 给一个网关前端发送广播命令，头部单独申请内存，消息内容直接引用共享的'body'
+func (this *TcpBroadcast) sendHead(link *TcpConn, limit int, clientIds []uint32, body []byte) error {
+	var size = this.headSize(len(clientIds))
+
+	if err := this.checkSize(link, limit, size, body); err != nil {
+		return err
+	}
+
+	var head, _, _ = link.framer.FrameSize(size + len(body))
+
+	var buff = link.memPool.Alloc(head + size)
+
+	if buff == nil {
+		return ErrPacketTooLarge
+	}
+
+	link.framer.EncodeFrame(buff, size+len(body))
+
+	var output = &TcpOutput{owner: link, buff: buff, Data: buff[head:], order: link.order}
+
+	output.WriteUint8(this.command)
+
+	switch this.command {
+	case _GATEWAY_COMMAND_BROADCAST_:
+		output.WriteUint16(uint16(len(clientIds)))
+
+		for _, clientId := range clientIds {
+			output.WriteUint32(clientId)
+		}
+	case _GATEWAY_COMMAND_GROUP_SEND_:
+		output.WriteUint32(this.groupId)
+	}
+
+	return link.sendHeadAndBody(buff, body)
+}
@@ -0,0 +1,126 @@
+package tcputil
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+//
+// 分组中一个可用的后端，交给'TcpGatewayBalancer'选择。
+//
+type TcpGatewayBackendState struct {
+	*TcpGatewayBackendInfo
+	Clients int // 网关前端上连到这个后端的客户端数量
+}
+
+//
+// 分组的后端选择策略，请参考'WithGatewayBalancer'。
+// 'Select'从'backends'中选出一个后端并返回它的下标，'backends'至少有一个元素，按后端ID从小到大排列，都是当前可用的后端。
+// 'key'是客户端握手时发送的键，没有发送时是客户端的IP地址，请参考'WithGatewayKey'。
+// 'Select'可能在不同的goroutine中被同时调用。
+//
+type TcpGatewayBalancer interface {
+	Select(key []byte, backends []*TcpGatewayBackendState) int
+}
+
+type tcpRoundRobinBalancer struct {
+	next uint32
+}
+
+//
+// 轮流选择分组中的后端，这是默认的策略。
+//
+func NewTcpRoundRobinBalancer() TcpGatewayBalancer {
+	return &tcpRoundRobinBalancer{}
+}
+
+func (this *tcpRoundRobinBalancer) Select(key []byte, backends []*TcpGatewayBackendState) int {
+	return int((atomic.AddUint32(&this.next, 1) - 1) % uint32(len(backends)))
+}
+
+type tcpLeastClientsBalancer struct{}
+
+//
+// 选择客户端最少的后端，数量相同时选择ID较小的。
+//
+func NewTcpLeastClientsBalancer() TcpGatewayBalancer {
+	return tcpLeastClientsBalancer{}
+}
+
+func (this tcpLeastClientsBalancer) Select(key []byte, backends []*TcpGatewayBackendState) int {
+	var selected = 0
+
+	for i, backend := range backends {
+		if backend.Clients < backends[selected].Clients {
+			selected = i
+		}
+	}
+
+	return selected
+}
+
+type tcpWeightedBalancer struct{}
+
+//
+// 按'TcpGatewayBackendInfo.Weight'的比例随机选择后端，权重小于等于0时按1处理。
+//
+func NewTcpWeightedBalancer() TcpGatewayBalancer {
+	return tcpWeightedBalancer{}
+}
+
+func (this tcpWeightedBalancer) Select(key []byte, backends []*TcpGatewayBackendState) int {
+	var total = 0
+
+	for _, backend := range backends {
+		total += backendWeight(backend)
+	}
+
+	var n = rand.Intn(total)
+
+	for i, backend := range backends {
+		if n -= backendWeight(backend); n < 0 {
+			return i
+		}
+	}
+
+	return len(backends) - 1
+}
+
+func backendWeight(backend *TcpGatewayBackendState) int {
+	if backend.Weight <= 0 {
+		return 1
+	}
+
+	return backend.Weight
+}
+
+type tcpHashBalancer struct{}
+
+//
+// 按客户端的键做一致性哈希，同一个键总是选到同一个后端，后端增减时只有原来选到变化的那个后端的键会改变选择。
+// 使用最高随机权重算法(rendezvous hashing)，不需要维护哈希环。
+//
+func NewTcpHashBalancer() TcpGatewayBalancer {
+	return tcpHashBalancer{}
+}
+
+func (this tcpHashBalancer) Select(key []byte, backends []*TcpGatewayBackendState) int {
+	var (
+		selected  = 0
+		bestScore uint64
+	)
+
+	for i, backend := range backends {
+		var hash = fnv.New64a()
+
+		hash.Write([]byte{byte(backend.Id), byte(backend.Id >> 8), byte(backend.Id >> 16), byte(backend.Id >> 24)})
+		hash.Write(key)
+
+		if score := hash.Sum64(); i == 0 || score > bestScore {
+			selected, bestScore = i, score
+		}
+	}
+
+	return selected
+}
@@ -1,7 +1,22 @@
 package tcputil
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	_SHUTDOWN_POLL_INTERVAL_ = 50 * time.Millisecond
+
+	_GATEWAY_HANDSHAKE_ACCEPTED_            = 0
+	_GATEWAY_HANDSHAKE_UNKNOWN_BACKEND_     = 1
+	_GATEWAY_HANDSHAKE_BACKEND_UNAVAILABLE_ = 2
 )
 
 //
@@ -11,8 +26,18 @@ type TcpGatewayFrontend struct {
 	server     *TcpListener
 	pack       int
 	memPool    MemPool
+	config     tcpConfig
+	order      binary.ByteOrder
 	links      map[uint32]*tcpGatewayLink
+	backends   map[uint32]*TcpGatewayBackendInfo
 	linksMutex sync.RWMutex
+	closed     bool
+	draining   bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	reconnecting map[uint32]*TcpGatewayBackendInfo
+	balancer     TcpGatewayBalancer // 没有通过'WithGatewayBalancer'设置策略的分组使用的默认策略
 }
 
 //
@@ -22,6 +47,8 @@ type TcpGatewayBackendInfo struct {
 	Id             uint32 // 后端ID
 	Addr           string // 地址
 	TakeClientAddr bool   // 是否在客户端首次连接时发送IP
+	Group          uint32 // 所属的后端分组，0表示不属于任何分组
+	Weight         int    // 在分组中的权重，只对'NewTcpWeightedBalancer'有效
 }
 
 //
@@ -36,112 +63,442 @@ type TcpGatewayUpdateResult struct {
 
 //
 // 在指定地址和端口创建一个网关前端，连接到指定的网关后端，并等待客户端接入。
-// 新接入的客户端首先需要发送一个uint32类型的后端ID，选择客户端实际所要连接的后端。
+// 新接入的客户端首先需要发送一个uint32类型的后端ID，选择客户端实际所要连接的后端，网关前端会回复一个uint8类型的握手结果，请参考'ConnectGateway'。
+// 客户端也可以发送后端分组的ID，由网关前端按'WithGatewayBalancer'设置的策略从分组中选择一个可用的后端，后端ID和分组ID相同时优先当作后端ID。
+// 按分组接入的客户端在后端连接断开或者后端被移出配置时不会被断开，而是转移到分组中其它可用的后端，新的后端会收到一个新的客户端接入，之前加入的网关分组需要重新加入。
+// 参数'opts'同时作用于客户端连接和到网关后端的连接，所以客户端和网关后端需要使用相同的字节序设置，'WithFramer'例外，它只作用于客户端连接。
 //
-func NewTcpGatewayFrontend(addr string, pack int, memPool MemPool, backends []*TcpGatewayBackendInfo) (*TcpGatewayFrontend, error) {
-	server, err := Listen(addr, pack, pack+4, memPool)
+func NewTcpGatewayFrontend(addr string, pack int, memPool MemPool, backends []*TcpGatewayBackendInfo, opts ...TcpOption) (*TcpGatewayFrontend, error) {
+	if _, err := NewTcpHeadFramer(pack, nil); err != nil {
+		return nil, err
+	}
+
+	var config = newTcpConfig(opts)
+
+	if framer, err := config.newFramer(pack); err != nil {
+		return nil, err
+	} else if !canHandshake(framer) {
+		return nil, errors.New("framer can't carry gateway handshake")
+	}
+
+	server, err := Listen(addr, pack, pack+1+4, memPool, opts...)
 
 	if err != nil {
 		return nil, err
 	}
 
 	var this = &TcpGatewayFrontend{
-		server:  server,
-		pack:    pack,
-		memPool: memPool,
-		links:   make(map[uint32]*tcpGatewayLink),
+		server:   server,
+		pack:     pack,
+		memPool:  memPool,
+		config:   server.config,
+		order:    server.config.order,
+		links:    make(map[uint32]*tcpGatewayLink),
+		backends: make(map[uint32]*TcpGatewayBackendInfo),
+
+		reconnecting: make(map[uint32]*TcpGatewayBackendInfo),
+		balancer:     NewTcpRoundRobinBalancer(),
 	}
 
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+
 	this.UpdateBackends(backends)
 
-	go func() {
-		for {
-			var client = this.server.Accpet()
+	go this.server.acceptLoop(func(conn *TcpConn) {
+		go func() {
+			defer func() {
+				conn.Close()
+			}()
+
+			var client = this.clientInit(conn)
 
 			if client == nil {
-				break
+				return
 			}
 
-			go func() {
-				defer func() {
-					client.Close()
-				}()
+			defer func() {
+				client.leave()
+			}()
 
-				var link, clientId = this.clientInit(client)
+			for {
+				var msg = conn.Read()
 
-				if link == nil || clientId == 0 {
-					return
+				if msg == nil {
+					break
 				}
 
-				defer func() {
-					link.DelClient(clientId)
-					link.SendDelClient(clientId)
-				}()
+				// 客户端可能已经被转移到其它后端，每个消息包都重新取一次
+				var link, clientId = client.route()
 
-				if link.takeClientAddr {
-					var addr = client.conn.RemoteAddr().String()
-					var addrMsg = client.NewPackage(4 + 2 + len(addr))
+				// 客户端的分帧方式可能允许比网关之间的头部更长的消息包，长度写不下时断开客户端，不能转发截断的长度
+				if _, _, err := link.conn.framer.FrameSize(len(msg) - pack); err != nil {
+					conn.Free(msg)
+					break
+				}
 
-					addrMsg.WriteUint32(clientId).WriteUint8(uint8(len(addr))).WriteBytes([]byte(addr))
+				// [gateway command](1) + [client id](4) + [real package content]
+				setUint(msg, pack, len(msg)-pack, this.order)
 
-					link.SendToBackend(addrMsg.buff)
-				}
+				msg[pack] = _GATEWAY_COMMAND_NONE_
 
-				for {
-					var msg = client.Read()
+				this.order.PutUint32(msg[pack+1:], clientId)
 
-					if msg == nil {
-						break
-					}
+				link.SendToBackend(msg)
+			}
+		}()
+	})
 
-					setUint(msg, pack, len(msg)-pack)
+	return this, nil
+}
 
-					setUint32(msg[pack:], clientId)
+//
+// 网关前端上的一个客户端，记录客户端当前所在的后端连接和客户端ID。
+//
+type tcpGatewayClient struct {
+	conn  *TcpConn
+	group uint32 // 按分组接入时是分组ID，否则是0
+	key   []byte
+
+	mutex  sync.Mutex
+	link   *tcpGatewayLink
+	id     uint32
+	closed bool
+}
 
-					link.SendToBackend(msg)
-				}
-			}()
+func (this *tcpGatewayClient) route() (*tcpGatewayLink, uint32) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.link, this.id
+}
+
+// 客户端断开以后通知后端，之后不会再被转移
+func (this *tcpGatewayClient) leave() {
+	this.mutex.Lock()
+
+	this.closed = true
+
+	var link, clientId = this.link, this.id
+
+	this.mutex.Unlock()
+
+	link.SendDelClient(clientId)
+	link.DelClient(clientId)
+}
+
+func (this *TcpGatewayFrontend) clientInit(conn *TcpConn) *tcpGatewayClient {
+	var serverIdMsg, _ = conn.readPacket(this.config.handshakeTimeout, ErrHandshakeTimeout, true)
+
+	// [backend id](4) + [client key]
+	if len(serverIdMsg) < this.pack+1+4+4 {
+		conn.Free(serverIdMsg)
+		return nil
+	}
+
+	var (
+		serverId = this.order.Uint32(serverIdMsg[this.pack+1+4:])
+		client   = &tcpGatewayClient{conn: conn}
+		result   uint8
+	)
+
+	if key := serverIdMsg[this.pack+1+4+4:]; len(key) > 0 {
+		client.key = append([]byte(nil), key...)
+	} else if host, _, err := net.SplitHostPort(conn.conn.RemoteAddr().String()); err == nil {
+		client.key = []byte(host)
+	}
+
+	conn.Free(serverIdMsg)
+
+	client.mutex.Lock()
+
+	if this.hasBackend(serverId) {
+		if link := this.getLink(serverId); link != nil {
+			client.link, client.id = link, link.AddClient(conn)
 		}
-	}()
+	} else if this.hasGroup(serverId) {
+		client.group = serverId
+		client.link, client.id = this.selectLink(client)
+	} else {
+		result = _GATEWAY_HANDSHAKE_UNKNOWN_BACKEND_
+	}
 
-	return this, nil
+	if client.id == 0 {
+		client.link = nil
+
+		if result == _GATEWAY_HANDSHAKE_ACCEPTED_ {
+			result = _GATEWAY_HANDSHAKE_BACKEND_UNAVAILABLE_
+		}
+	} else {
+		this.sendAddClient(client)
+	}
+
+	// 解锁以后客户端随时可能被转移，不能再直接读取client.link
+	var accepted = client.link != nil
+
+	client.mutex.Unlock()
+
+	var reply = conn.NewPackage(1)
+
+	if reply == nil || reply.WriteUint8(result).Send() != nil || !accepted {
+		if accepted {
+			client.leave()
+		}
+		return nil
+	}
+
+	return client
 }
 
-func (this *TcpGatewayFrontend) clientInit(client *TcpConn) (link *tcpGatewayLink, clientId uint32) {
+// 通知客户端所在的后端有新的客户端接入，调用者需要持有客户端的mutex
+func (this *TcpGatewayFrontend) sendAddClient(client *tcpGatewayClient) {
+	var addr string
+
+	if client.link.takeClientAddr {
+		addr = client.conn.conn.RemoteAddr().String()
+	}
+
+	client.link.SendAddClient(client.id, this.config.frontendId, addr)
+}
+
+//
+// 按分组的选择策略从可用的后端中选择一个并加入客户端，分组中没有可用的后端时返回nil。
+//
+func (this *TcpGatewayFrontend) selectLink(client *tcpGatewayClient) (*tcpGatewayLink, uint32) {
 	var (
-		serverIdMsg []byte
-		serverId    uint32
+		links    []*tcpGatewayLink
+		balancer TcpGatewayBalancer
 	)
 
-	if serverIdMsg = client.Read(); len(serverIdMsg) != this.pack+4+4 {
-		return
+	this.linksMutex.RLock()
+
+	if !this.closed && !this.draining {
+		for id, link := range this.links {
+			if backend := this.backends[id]; backend != nil && backend.Group == client.group && backend.Addr == link.addr {
+				links = append(links, link)
+			}
+		}
 	}
 
-	serverId = getUint32(serverIdMsg[this.pack+4:])
+	if balancer = this.config.balancers[client.group]; balancer == nil {
+		balancer = this.balancer
+	}
 
-	if link = this.getLink(serverId); link == nil {
-		return
+	this.linksMutex.RUnlock()
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].id < links[j].id
+	})
+
+	for len(links) > 0 {
+		var (
+			available = links[:0]
+			states    = make([]*TcpGatewayBackendState, 0, len(links))
+		)
+
+		this.linksMutex.RLock()
+
+		for _, link := range links {
+			if clients, ok := link.Load(); ok {
+				if backend := this.backends[link.id]; backend != nil {
+					available = append(available, link)
+					states = append(states, &TcpGatewayBackendState{backend, clients})
+				}
+			}
+		}
+
+		this.linksMutex.RUnlock()
+
+		if len(available) == 0 {
+			break
+		}
+
+		var selected = balancer.Select(client.key, states)
+
+		if selected < 0 || selected >= len(available) {
+			selected = 0
+		}
+
+		if clientId := available[selected].AddMovableClient(client); clientId != 0 {
+			return available[selected], clientId
+		}
+
+		// 刚好被关闭或者客户端ID已经用完，换一个后端再选
+		links = append(available[:selected], available[selected+1:]...)
 	}
 
-	if clientId = link.AddClient(client); clientId == 0 {
-		return
+	return nil, 0
+}
+
+//
+// 后端连接断开以后，把按分组接入的客户端转移到同一个分组的其它后端，分组中没有可用的后端时断开客户端。
+//
+func (this *TcpGatewayFrontend) failover(clients []*tcpGatewayClient) {
+	for _, client := range clients {
+		client.mutex.Lock()
+
+		var failed = false
+
+		if !client.closed {
+			if link, clientId := this.selectLink(client); link != nil {
+				client.link, client.id = link, clientId
+				this.sendAddClient(client)
+			} else {
+				failed = true
+			}
+		}
+
+		client.mutex.Unlock()
+
+		if failed {
+			client.conn.Close()
+		}
 	}
+}
+
+func (this *TcpGatewayFrontend) hasGroup(group uint32) bool {
+	this.linksMutex.RLock()
+	defer this.linksMutex.RUnlock()
 
-	return
+	if group == 0 {
+		return false
+	}
+
+	for _, backend := range this.backends {
+		if backend.Group == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 客户端握手时发送4字节的后端ID，网关前端回复1字节的握手结果，分帧方式必须能够传输这两种消息包
+func canHandshake(framer TcpFramer) bool {
+	for _, size := range []int{4, 1} {
+		if _, _, err := framer.FrameSize(size); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *TcpGatewayFrontend) hasBackend(id uint32) bool {
+	this.linksMutex.RLock()
+	defer this.linksMutex.RUnlock()
+
+	var _, exists = this.backends[id]
+
+	return exists
 }
 
-func (this *TcpGatewayFrontend) addLink(id uint32, link *tcpGatewayLink) {
+//
+// 加入一个新建立的连接，如果同一个后端已经有连接了，或者后端已经不在配置中，或者网关前端已经关闭，就放弃新连接。
+//
+func (this *TcpGatewayFrontend) addLink(backend *TcpGatewayBackendInfo, link *tcpGatewayLink) bool {
 	this.linksMutex.Lock()
 	defer this.linksMutex.Unlock()
 
-	this.links[id] = link
+	if this.closed || this.draining || !this.configured(backend) || this.links[backend.Id] != nil {
+		return false
+	}
+
+	this.links[backend.Id] = link
+	link.announced = true
+
+	return true
 }
 
-func (this *TcpGatewayFrontend) delLink(id uint32) {
+//
+// 连接断开以后从网关前端移除，并且在后端还在配置中时开始自动重连。
+//
+func (this *TcpGatewayFrontend) linkClosed(link *tcpGatewayLink, err error) {
 	this.linksMutex.Lock()
-	defer this.linksMutex.Unlock()
 
-	delete(this.links, id)
+	var announced = link.announced
+
+	// 连接可能已经被'UpdateBackends'移除，同一个ID也可能已经换成了新连接
+	if this.links[link.id] == link {
+		delete(this.links, link.id)
+
+		if !this.closed && this.configured(link.backend) {
+			this.startReconnect(link.backend)
+		}
+	}
+
+	this.linksMutex.Unlock()
+
+	if announced {
+		this.config.emitLinkEvent(link.id, link.addr, false, err)
+	}
+}
+
+//
+// 开始重连一个后端，调用者需要持有linksMutex。
+//
+func (this *TcpGatewayFrontend) startReconnect(backend *TcpGatewayBackendInfo) {
+	if this.config.reconnectMin <= 0 || this.draining {
+		return
+	}
+
+	if current, exists := this.reconnecting[backend.Id]; exists && current.Addr == backend.Addr {
+		return
+	}
+
+	this.reconnecting[backend.Id] = backend
+
+	go this.reconnect(backend)
+}
+
+//
+// 按指数退避的间隔重连后端，每次等待时间随机抖动，避免大量网关前端同时重连，直到连接成功或者后端被移出配置。
+//
+func (this *TcpGatewayFrontend) reconnect(backend *TcpGatewayBackendInfo) {
+	defer func() {
+		this.linksMutex.Lock()
+		if this.reconnecting[backend.Id] == backend {
+			delete(this.reconnecting, backend.Id)
+		}
+		this.linksMutex.Unlock()
+	}()
+
+	var delay = this.config.reconnectMin
+
+	for {
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+
+		if !this.wantLink(backend) {
+			return
+		}
+
+		if link, err := newTcpGatewayLink(this.ctx, this, backend, this.pack, this.memPool); err == nil {
+			if this.addLink(backend, link) {
+				this.config.emitLinkEvent(backend.Id, backend.Addr, true, nil)
+			} else {
+				link.Close()
+			}
+			return
+		}
+
+		if delay *= 2; delay > this.config.reconnectMax {
+			delay = this.config.reconnectMax
+		}
+	}
+}
+
+// 后端是否还在配置中，地址变化了也算不在配置中，调用者需要持有linksMutex
+func (this *TcpGatewayFrontend) configured(backend *TcpGatewayBackendInfo) bool {
+	var current, exists = this.backends[backend.Id]
+
+	return exists && current.Addr == backend.Addr
+}
+
+// 后端是否还在配置中并且没有可用的连接
+func (this *TcpGatewayFrontend) wantLink(backend *TcpGatewayBackendInfo) bool {
+	this.linksMutex.RLock()
+	defer this.linksMutex.RUnlock()
+
+	return !this.closed && !this.draining && this.configured(backend) && this.links[backend.Id] == nil
 }
 
 func (this *TcpGatewayFrontend) getLink(id uint32) *tcpGatewayLink {
@@ -172,7 +529,8 @@ func (this *TcpGatewayFrontend) removeOldLinks(backends []*TcpGatewayBackendInfo
 		}
 
 		if needClose {
-			link.Close(false)
+			delete(this.links, id)
+			link.Close()
 			results = append(results, &TcpGatewayUpdateResult{id, false, link.addr, nil})
 		}
 	}
@@ -182,19 +540,44 @@ func (this *TcpGatewayFrontend) removeOldLinks(backends []*TcpGatewayBackendInfo
 
 //
 // 更新网关后端，移除地址有变化或者已经不在新配置里的久连接，创建久配置中没有的连接。
+// 连接创建失败或者之后断开的后端，只要还在配置中，网关前端就会在后台自动重连，请参考'WithReconnect'。
 //
 func (this *TcpGatewayFrontend) UpdateBackends(backends []*TcpGatewayBackendInfo) []*TcpGatewayUpdateResult {
+	return this.UpdateBackendsContext(context.Background(), backends)
+}
+
+//
+// 跟'UpdateBackends'一样，区别是可以通过'ctx'取消正在进行的连接操作，被取消的后端仍然会在后台自动重连。
+//
+func (this *TcpGatewayFrontend) UpdateBackendsContext(ctx context.Context, backends []*TcpGatewayBackendInfo) []*TcpGatewayUpdateResult {
 	var results = this.removeOldLinks(backends)
 
+	this.linksMutex.Lock()
+	this.backends = make(map[uint32]*TcpGatewayBackendInfo, len(backends))
+	for _, backend := range backends {
+		this.backends[backend.Id] = backend
+	}
+	this.linksMutex.Unlock()
+
 	for _, backend := range backends {
 		if this.getLink(backend.Id) != nil {
 			continue
 		}
 
-		var link, err = newTcpGatewayLink(this, backend, this.pack, this.memPool)
+		var link, err = newTcpGatewayLink(ctx, this, backend, this.pack, this.memPool)
 
 		if link != nil {
-			this.addLink(backend.Id, link)
+			if this.addLink(backend, link) {
+				this.config.emitLinkEvent(backend.Id, backend.Addr, true, nil)
+			} else {
+				link.Close()
+			}
+		} else {
+			this.linksMutex.Lock()
+			if this.configured(backend) {
+				this.startReconnect(backend)
+			}
+			this.linksMutex.Unlock()
 		}
 
 		results = append(results, &TcpGatewayUpdateResult{backend.Id, true, backend.Addr, err})
@@ -210,9 +593,60 @@ func (this *TcpGatewayFrontend) Close() {
 	this.linksMutex.Lock()
 	defer this.linksMutex.Unlock()
 
+	this.closed = true
+
+	this.cancel()
+
 	this.server.Close()
 
 	for _, link := range this.links {
-		link.Close(false)
+		link.Close()
+	}
+}
+
+//
+// 优雅的关闭网关前端，不再接受新的客户端，通知所有后端网关前端正在排空，等现有客户端全部断开后再关闭。
+// 如果'ctx'先结束，就直接关闭剩下的连接，发送队列中的消息包仍然会尽量写完，这时返回ctx.Err()。
+//
+func (this *TcpGatewayFrontend) Shutdown(ctx context.Context) error {
+	this.linksMutex.Lock()
+
+	this.draining = true
+
+	var links = make([]*tcpGatewayLink, 0, len(this.links))
+
+	for _, link := range this.links {
+		links = append(links, link)
+	}
+
+	this.linksMutex.Unlock()
+
+	this.server.Close()
+
+	for _, link := range links {
+		sendLinkCommand(link.conn, _GATEWAY_COMMAND_DRAIN_)
+		link.Drain()
+	}
+
+	var ticker = time.NewTicker(_SHUTDOWN_POLL_INTERVAL_)
+
+	defer ticker.Stop()
+
+	for {
+		this.linksMutex.RLock()
+		var remain = len(this.links)
+		this.linksMutex.RUnlock()
+
+		if remain == 0 {
+			this.Close()
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			this.Close()
+			return ctx.Err()
+		}
 	}
 }
@@ -1,17 +1,95 @@
 package tcputil
 
 import (
+	"context"
 	"errors"
+	"math"
 	"sync"
+	"time"
 )
 
 const (
-	_GATEWAY_COMMAND_NONE_       = 0
-	_GATEWAY_COMMAND_ADD_CLIENT_ = 1
-	_GATEWAY_COMMAND_DEL_CLIENT_ = 2
-	_GATEWAY_COMMAND_BROADCAST_  = 3
+	_GATEWAY_COMMAND_NONE_          = 0
+	_GATEWAY_COMMAND_ADD_CLIENT_    = 1
+	_GATEWAY_COMMAND_DEL_CLIENT_    = 2
+	_GATEWAY_COMMAND_BROADCAST_     = 3
+	_GATEWAY_COMMAND_PING_          = 4
+	_GATEWAY_COMMAND_PONG_          = 5
+	_GATEWAY_COMMAND_DRAIN_         = 6
+	_GATEWAY_COMMAND_BROADCAST_ALL_ = 7
+	_GATEWAY_COMMAND_GROUP_JOIN_    = 8
+	_GATEWAY_COMMAND_GROUP_LEAVE_   = 9
+	_GATEWAY_COMMAND_GROUP_SEND_    = 10
 )
 
+const (
+	_GATEWAY_BROADCAST_MAX_IDS_ = 0xFFFF // 一个广播命令最多携带的客户端ID数量，超过的分成多个命令发送
+)
+
+const (
+	_GATEWAY_DIAL_TIMEOUT_ = 10 * time.Second
+)
+
+//
+// 网关前端和网关后端之间的连接状态变化事件，请参考'WithGatewayLinkEvent'。
+//
+type TcpGatewayLinkEvent struct {
+	Id    uint32 // 在网关前端是后端ID，在网关后端是连接序号
+	Addr  string // 对方的地址
+	Up    bool   // true表示连接建立，false表示连接断开
+	Error error  // 连接断开的原因，例如心跳超时是ErrHeartbeatTimeout
+}
+
+//
+// 定时发送心跳包，直到连接关闭。
+//
+func heartbeatLoop(conn *TcpConn, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	var ticker = time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if sendLinkCommand(conn, _GATEWAY_COMMAND_PING_) != nil {
+				return
+			}
+		case <-conn.closeChan:
+			return
+		}
+	}
+}
+
+//
+// 发送只有一个命令字节的网关命令，内存池或者分帧规则连一个字节的消息包都放不下时连接没法正常工作，直接断开。
+//
+func sendLinkCommand(conn *TcpConn, command uint8) error {
+	var output = conn.NewPackage(1)
+
+	if output == nil {
+		conn.setErr(ErrPacketTooLarge)
+		conn.Close()
+		return ErrPacketTooLarge
+	}
+
+	return output.WriteUint8(command).Send()
+}
+
+//
+// 读取网关之间的消息包，开启心跳时超过'heartbeatTimeout'没有收到完整的消息包就断开连接。
+//
+func readLinkPacket(conn *TcpConn, heartbeatTimeout time.Duration) ([]byte, error) {
+	if heartbeatTimeout > 0 {
+		return conn.readPacket(heartbeatTimeout, ErrHeartbeatTimeout, true)
+	}
+
+	return conn.ReadPacket()
+}
+
 type tcpGatewayLink struct {
 	owner          *TcpGatewayFrontend
 	id             uint32
@@ -19,29 +97,67 @@ type tcpGatewayLink struct {
 	pack           int
 	conn           *TcpConn
 	clients        map[uint32]*TcpConn
+	groups         map[uint32]map[uint32]*TcpConn // 分组ID到组内客户端，由clientsMutex保护
+	clientGroups   map[uint32][]uint32            // 客户端加入的分组，用于断开时退出分组，由clientsMutex保护
+	movable        map[uint32]*tcpGatewayClient   // 按后端分组接入的客户端，连接断开时转移到分组中的其它后端，由clientsMutex保护
 	clientsMutex   sync.RWMutex
-	maxClientId    uint32
+	beginClientId  uint32 // 客户端ID的高位，由后端分配，低位在本连接内分配
+	maxLocalId     uint32 // 低位的最大值
+	lastLocalId    uint32 // 上一次分配的低位，下一次从它之后开始找，避免刚断开的客户端ID马上被重用
 	takeClientAddr bool
+	backend        *TcpGatewayBackendInfo
+	announced      bool // 是否已经加入网关前端并发出了连接建立事件，由网关前端的linksMutex保护
+	draining       bool // 不再接受新的客户端，现有客户端全部断开后关闭连接，由clientsMutex保护
+	closed         bool // 由clientsMutex保护
 }
 
-func newTcpGatewayLink(owner *TcpGatewayFrontend, backend *TcpGatewayBackendInfo, pack int, memPool MemPool) (*tcpGatewayLink, error) {
+func newTcpGatewayLink(ctx context.Context, owner *TcpGatewayFrontend, backend *TcpGatewayBackendInfo, pack int, memPool MemPool) (*tcpGatewayLink, error) {
 	var (
 		this             *tcpGatewayLink
 		conn             *TcpConn
 		err              error
 		beginClientIdMsg []byte
 		beginClientId    uint32
+		linkBits         int
 	)
 
-	if conn, err = Connect(backend.Addr, pack, 0, memPool); err != nil {
+	if owner.config.dialTimeout <= 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, _GATEWAY_DIAL_TIMEOUT_)
+
+		defer cancel()
+	}
+
+	if conn, err = dialTcp(ctx, backend.Addr, owner.config.linkConfig(), pack, 0, memPool); err != nil {
 		return nil, err
 	}
 
-	if beginClientIdMsg = conn.Read(); beginClientIdMsg == nil {
+	// [max packet size](4)，读取网关命令时内存池允许的最大长度，0表示不知道，网关后端据此拆分广播命令
+	var limit = uint64(memPoolMaxSize(memPool))
+
+	if limit > math.MaxUint32 {
+		limit = 0
+	}
+
+	if limitMsg := conn.NewPackage(4); limitMsg == nil || limitMsg.WriteUint32(uint32(limit)).Send() != nil {
+		conn.Close()
+		return nil, errors.New("send link limit failed")
+	}
+
+	// [begin client id](4) + [link bits](1)
+	if beginClientIdMsg, err = conn.readPacket(owner.config.handshakeTimeout, ErrHandshakeTimeout, true); err != nil || len(beginClientIdMsg) != 4+1 {
+		conn.Close()
 		return nil, errors.New("wait link id failed")
 	}
 
-	beginClientId = getUint32(beginClientIdMsg)
+	beginClientId = conn.order.Uint32(beginClientIdMsg)
+	linkBits = int(beginClientIdMsg[4])
+
+	if linkBits < _GATEWAY_MIN_LINK_BITS_ || linkBits > _GATEWAY_MAX_LINK_BITS_ {
+		conn.Close()
+		return nil, errors.New("bad link bits")
+	}
 
 	this = &tcpGatewayLink{
 		owner:          owner,
@@ -50,26 +166,42 @@ func newTcpGatewayLink(owner *TcpGatewayFrontend, backend *TcpGatewayBackendInfo
 		pack:           pack,
 		conn:           conn,
 		clients:        make(map[uint32]*TcpConn),
-		maxClientId:    beginClientId,
+		groups:         make(map[uint32]map[uint32]*TcpConn),
+		clientGroups:   make(map[uint32][]uint32),
+		movable:        make(map[uint32]*tcpGatewayClient),
+		beginClientId:  beginClientId,
+		maxLocalId:     1<<uint(32-linkBits) - 1,
 		takeClientAddr: backend.TakeClientAddr,
+		backend:        backend,
 	}
 
+	go heartbeatLoop(conn, owner.config.heartbeatInterval)
+
 	go func() {
-		defer this.Close(true)
+		var err error
+
+		defer func() {
+			this.Close()
+			owner.linkClosed(this, err)
+		}()
 
 		for {
-			var msg = this.conn.ReadPackage()
+			var buff []byte
 
-			if msg == nil {
+			if buff, err = readLinkPacket(this.conn, owner.config.heartbeatTimeout()); err != nil {
 				break
 			}
 
+			var msg = NewTcpInputWithOrder(buff, this.conn.order).Safe()
+
 			switch msg.ReadUint8() {
 			case _GATEWAY_COMMAND_NONE_:
 				var clientId = msg.ReadUint32()
 
-				if client := this.GetClient(clientId); client != nil {
-					client.sendRaw(msg.Data)
+				if client := this.GetClient(clientId); client != nil && msg.Err() == nil {
+					client.sendAndFree(msg.Data, buff)
+				} else {
+					this.conn.Free(buff)
 				}
 			case _GATEWAY_COMMAND_DEL_CLIENT_:
 				var clientId = msg.ReadUint32()
@@ -78,19 +210,73 @@ func newTcpGatewayLink(owner *TcpGatewayFrontend, backend *TcpGatewayBackendInfo
 					client.Close()
 					this.DelClient(clientId)
 				}
+
+				this.conn.Free(buff)
 			case _GATEWAY_COMMAND_BROADCAST_:
+				// 广播包同时发给多个客户端，不知道什么时候全部写完，所以不回收
 				var (
 					idNum   = int(msg.ReadUint16())
-					realMsg = msg.Data[4*idNum:]
+					ids     = NewTcpInputWithOrder(msg.ReadBytes(4*idNum), msg.order)
+					realMsg = msg.Data
 				)
 
+				if msg.Err() != nil {
+					break
+				}
+
 				for i := 0; i < idNum; i++ {
-					var clientId = msg.ReadUint32()
+					var clientId = ids.ReadUint32()
 
 					if client := this.GetClient(clientId); client != nil {
 						client.sendRaw(realMsg)
 					}
 				}
+			case _GATEWAY_COMMAND_BROADCAST_ALL_:
+				// 同上，不回收
+				for _, client := range this.Clients() {
+					client.sendRaw(msg.Data)
+				}
+			case _GATEWAY_COMMAND_GROUP_JOIN_:
+				var (
+					groupId  = msg.ReadUint32()
+					clientId = msg.ReadUint32()
+				)
+
+				if msg.Err() == nil {
+					this.JoinGroup(groupId, clientId)
+				}
+
+				this.conn.Free(buff)
+			case _GATEWAY_COMMAND_GROUP_LEAVE_:
+				var (
+					groupId  = msg.ReadUint32()
+					clientId = msg.ReadUint32()
+				)
+
+				if msg.Err() == nil {
+					this.LeaveGroup(groupId, clientId)
+				}
+
+				this.conn.Free(buff)
+			case _GATEWAY_COMMAND_GROUP_SEND_:
+				// 同上，不回收
+				var groupId = msg.ReadUint32()
+
+				if msg.Err() != nil {
+					break
+				}
+
+				for _, client := range this.GroupClients(groupId) {
+					client.sendRaw(msg.Data)
+				}
+			case _GATEWAY_COMMAND_PING_:
+				sendLinkCommand(this.conn, _GATEWAY_COMMAND_PONG_)
+				this.conn.Free(buff)
+			case _GATEWAY_COMMAND_DRAIN_:
+				this.Drain()
+				this.conn.Free(buff)
+			default:
+				this.conn.Free(buff)
 			}
 		}
 	}()
@@ -99,21 +285,198 @@ func newTcpGatewayLink(owner *TcpGatewayFrontend, backend *TcpGatewayBackendInfo
 }
 
 func (this *tcpGatewayLink) AddClient(client *TcpConn) uint32 {
+	return this.addClient(client, nil)
+}
+
+//
+// 跟'AddClient'一样，区别是连接断开时客户端不会被断开，而是交给网关前端转移到同一个分组的其它后端。
+//
+func (this *tcpGatewayLink) AddMovableClient(client *tcpGatewayClient) uint32 {
+	return this.addClient(client.conn, client)
+}
+
+func (this *tcpGatewayLink) addClient(client *TcpConn, movable *tcpGatewayClient) uint32 {
 	this.clientsMutex.Lock()
 	defer this.clientsMutex.Unlock()
 
-	this.maxClientId += 1
+	if this.draining || this.closed {
+		return 0
+	}
+
+	// 低位0不用，保证客户端ID不是0，轮流使用其余的值，跳过还在线的客户端
+	for i := uint32(0); i < this.maxLocalId; i++ {
+		this.lastLocalId = this.lastLocalId%this.maxLocalId + 1
+
+		var clientId = this.beginClientId | this.lastLocalId
+
+		if _, used := this.clients[clientId]; !used {
+			this.clients[clientId] = client
 
-	this.clients[this.maxClientId] = client
+			if movable != nil {
+				this.movable[clientId] = movable
+			}
 
-	return this.maxClientId
+			return clientId
+		}
+	}
+
+	// 客户端ID已经用完
+	return 0
 }
 
 func (this *tcpGatewayLink) DelClient(clientId uint32) {
 	this.clientsMutex.Lock()
-	defer this.clientsMutex.Unlock()
 
+	this.removeClient(clientId)
+
+	var drained = this.draining && len(this.clients) == 0
+
+	this.clientsMutex.Unlock()
+
+	if drained {
+		this.conn.Close()
+	}
+}
+
+// 调用者需要持有clientsMutex
+func (this *tcpGatewayLink) removeClient(clientId uint32) {
 	delete(this.clients, clientId)
+	delete(this.movable, clientId)
+
+	for _, groupId := range this.clientGroups[clientId] {
+		this.removeFromGroup(groupId, clientId)
+	}
+
+	delete(this.clientGroups, clientId)
+}
+
+//
+// 返回当前的客户端数量，连接已经关闭或者正在排空时'available'是false。
+//
+func (this *tcpGatewayLink) Load() (clients int, available bool) {
+	this.clientsMutex.RLock()
+	defer this.clientsMutex.RUnlock()
+
+	return len(this.clients), !this.closed && !this.draining
+}
+
+//
+// 进入排空状态，不再接受新的客户端，等现有客户端全部断开后关闭连接。
+//
+func (this *tcpGatewayLink) Drain() {
+	this.clientsMutex.Lock()
+
+	this.draining = true
+
+	var drained = len(this.clients) == 0
+
+	this.clientsMutex.Unlock()
+
+	if drained {
+		this.conn.Close()
+	}
+}
+
+//
+// 返回当前所有客户端，发送时不持有锁，避免发送队列满的时候阻塞其它客户端的接入和断开。
+//
+func (this *tcpGatewayLink) Clients() []*TcpConn {
+	this.clientsMutex.RLock()
+	defer this.clientsMutex.RUnlock()
+
+	var clients = make([]*TcpConn, 0, len(this.clients))
+
+	for _, client := range this.clients {
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+//
+// 把客户端加入分组，客户端不在线或者已经在分组中时什么都不做。
+//
+func (this *tcpGatewayLink) JoinGroup(groupId, clientId uint32) {
+	this.clientsMutex.Lock()
+	defer this.clientsMutex.Unlock()
+
+	var client, exists = this.clients[clientId]
+
+	if !exists {
+		return
+	}
+
+	var group = this.groups[groupId]
+
+	if group == nil {
+		group = make(map[uint32]*TcpConn)
+		this.groups[groupId] = group
+	}
+
+	if _, joined := group[clientId]; joined {
+		return
+	}
+
+	group[clientId] = client
+
+	this.clientGroups[clientId] = append(this.clientGroups[clientId], groupId)
+}
+
+//
+// 把客户端移出分组。
+//
+func (this *tcpGatewayLink) LeaveGroup(groupId, clientId uint32) {
+	this.clientsMutex.Lock()
+	defer this.clientsMutex.Unlock()
+
+	if _, joined := this.groups[groupId][clientId]; !joined {
+		return
+	}
+
+	this.removeFromGroup(groupId, clientId)
+
+	var groupIds = this.clientGroups[clientId]
+
+	for i, id := range groupIds {
+		if id == groupId {
+			groupIds = append(groupIds[:i], groupIds[i+1:]...)
+			break
+		}
+	}
+
+	if len(groupIds) == 0 {
+		delete(this.clientGroups, clientId)
+	} else {
+		this.clientGroups[clientId] = groupIds
+	}
+}
+
+// 调用者需要持有clientsMutex，分组空了以后删除，避免分组ID一直增长时占用内存
+func (this *tcpGatewayLink) removeFromGroup(groupId, clientId uint32) {
+	var group = this.groups[groupId]
+
+	delete(group, clientId)
+
+	if len(group) == 0 {
+		delete(this.groups, groupId)
+	}
+}
+
+//
+// 返回分组中的所有客户端，跟'Clients'一样发送时不持有锁。
+//
+func (this *tcpGatewayLink) GroupClients(groupId uint32) []*TcpConn {
+	this.clientsMutex.RLock()
+	defer this.clientsMutex.RUnlock()
+
+	var group = this.groups[groupId]
+	var clients = make([]*TcpConn, 0, len(group))
+
+	for _, client := range group {
+		clients = append(clients, client)
+	}
+
+	return clients
 }
 
 func (this *tcpGatewayLink) GetClient(clientId uint32) *TcpConn {
@@ -127,25 +490,64 @@ func (this *tcpGatewayLink) GetClient(clientId uint32) *TcpConn {
 	return nil
 }
 
-func (this *tcpGatewayLink) SendDelClient(clientId uint32) {
-	this.conn.NewPackage(4).WriteUint32(clientId).Send()
+//
+// 通知后端有新的客户端接入，'addr'在没有开启TakeClientAddr时是空字符串。
+// 申请不到内存时后端就没法知道客户端的进出，直接断开这个连接，连接上的客户端会跟着断开或者转移。
+//
+func (this *tcpGatewayLink) SendAddClient(clientId, frontendId uint32, addr string) error {
+	// [gateway command](1) + [client id](4) + [frontend id](4) + [connect time](8) + [client addr](1 + len)
+	var output = this.conn.NewPackage(1 + 4 + 4 + 8 + 1 + len(addr))
+
+	if output == nil {
+		return this.conn.expire(ErrPacketTooLarge)
+	}
+
+	return output.WriteUint8(_GATEWAY_COMMAND_ADD_CLIENT_).WriteUint32(clientId).WriteUint32(frontendId).WriteInt64(time.Now().UnixNano()).WriteString8(addr).Send()
+}
+
+//
+// 通知后端客户端已经断开，申请不到内存时的处理同'SendAddClient'。
+//
+func (this *tcpGatewayLink) SendDelClient(clientId uint32) error {
+	// [gateway command](1) + [client id](4)
+	var output = this.conn.NewPackage(1 + 4)
+
+	if output == nil {
+		return this.conn.expire(ErrPacketTooLarge)
+	}
+
+	return output.WriteUint8(_GATEWAY_COMMAND_DEL_CLIENT_).WriteUint32(clientId).Send()
 }
 
+//
+// 把客户端的消息包转发给后端，写出以后'msg'会被还给内存池。
+//
 func (this *tcpGatewayLink) SendToBackend(msg []byte) error {
-	return this.conn.sendRaw(msg)
+	return this.conn.sendAndFree(msg, msg)
 }
 
-func (this *tcpGatewayLink) Close(removeFromFrontend bool) {
+func (this *tcpGatewayLink) Close() {
 	this.clientsMutex.Lock()
-	defer this.clientsMutex.Unlock()
+
+	this.closed = true
 
 	this.conn.Close()
 
-	for _, client := range this.clients {
-		client.Close()
+	var moving = make([]*tcpGatewayClient, 0, len(this.movable))
+
+	for clientId, client := range this.clients {
+		if movable, exists := this.movable[clientId]; exists {
+			moving = append(moving, movable)
+			this.removeClient(clientId)
+		} else {
+			client.Close()
+		}
 	}
 
-	if removeFromFrontend {
-		this.owner.delLink(this.id)
+	this.clientsMutex.Unlock()
+
+	// 网关前端关闭时会持有linksMutex调用Close，所以另开goroutine转移客户端
+	if len(moving) > 0 {
+		go this.owner.failover(moving)
 	}
 }
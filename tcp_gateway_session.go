@@ -0,0 +1,263 @@
+package tcputil
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// 网关后端的客户端会话事件处理，请参考'NewTcpGatewaySessionBackend'。
+// 同一个会话的事件按顺序在同一个goroutine中调用，不同网关前端过来的会话可能并发调用。
+//
+type TcpGatewaySessionHandler interface {
+	// 客户端接入，'session.Addr'在网关前端开启了TakeClientAddr时是客户端地址，否则是空字符串
+	OnConnect(session *TcpGatewaySession)
+
+	// 收到客户端的消息包，客户端发送的空消息包也会原样交给'OnMessage'
+	OnMessage(session *TcpGatewaySession, msg *TcpInput)
+
+	// 客户端断开，之后就不会再收到这个会话的事件。
+	// 客户端自己断开或者被'Close'移除时'reason'是ErrConnClosed，跟网关前端的连接断开时是连接断开的原因，网关后端关闭时是'TcpGatewayBackend.Err'
+	OnDisconnect(session *TcpGatewaySession, reason error)
+}
+
+//
+// 网关后端上一个客户端的会话，从'OnConnect'开始到'OnDisconnect'结束。
+//
+type TcpGatewaySession struct {
+	backend     *TcpGatewayBackend
+	id          uint32
+	frontendId  uint32
+	connectTime time.Time
+	addr        string
+
+	mutex sync.Mutex
+	data  interface{}
+}
+
+//
+// 客户端ID。
+//
+func (this *TcpGatewaySession) Id() uint32 {
+	return this.id
+}
+
+//
+// 客户端地址，网关前端没有开启TakeClientAddr时是空字符串。
+//
+func (this *TcpGatewaySession) Addr() string {
+	return this.addr
+}
+
+//
+// 客户端所在的网关前端的ID，请参考'WithGatewayFrontendId'。
+//
+func (this *TcpGatewaySession) FrontendId() uint32 {
+	return this.frontendId
+}
+
+//
+// 客户端连上网关前端的时间，以网关前端的时钟为准。
+//
+func (this *TcpGatewaySession) ConnectTime() time.Time {
+	return this.connectTime
+}
+
+//
+// 客户端所在的网关前端连接的序号，跟网关后端的'TcpGatewayLinkEvent.Id'一致。
+//
+func (this *TcpGatewaySession) LinkId() uint32 {
+	return uint32(this.backend.linkId(this.id))
+}
+
+//
+// 关联一个用户数据，例如登录以后的玩家对象，会替换之前关联的数据。
+//
+func (this *TcpGatewaySession) Attach(data interface{}) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.data = data
+}
+
+//
+// 取消关联的用户数据，并返回之前关联的数据。
+//
+func (this *TcpGatewaySession) Detach() interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var data = this.data
+
+	this.data = nil
+
+	return data
+}
+
+//
+// 返回关联的用户数据，没有关联时返回nil。
+//
+func (this *TcpGatewaySession) Data() interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.data
+}
+
+//
+// 创建一个发送给这个客户端的消息包，请参考'TcpGatewayBackend.NewPackage'。
+//
+func (this *TcpGatewaySession) NewPackage(size int) *TcpOutput {
+	return this.backend.NewPackage(this.id, size)
+}
+
+//
+// 把'data'作为一个消息包发送给这个客户端。
+//
+func (this *TcpGatewaySession) Send(data []byte) error {
+	var output = this.backend.NewPackage(this.id, len(data))
+
+	if output == nil {
+		return ErrPacketTooLarge
+	}
+
+	return output.WriteBytes(data).Send()
+}
+
+//
+// 把这个客户端加入分组，请参考'TcpGatewayBackend.JoinGroup'。
+//
+func (this *TcpGatewaySession) JoinGroup(groupId uint32) {
+	this.backend.JoinGroup(groupId, this.id)
+}
+
+//
+// 把这个客户端移出分组。
+//
+func (this *TcpGatewaySession) LeaveGroup(groupId uint32) {
+	this.backend.LeaveGroup(groupId, this.id)
+}
+
+//
+// 通知网关前端断开这个客户端，断开以后会收到'OnDisconnect'。
+//
+func (this *TcpGatewaySession) Close() {
+	this.backend.DelClient(this.id)
+}
+
+type tcpGatewaySessions struct {
+	backend  *TcpGatewayBackend
+	handler  TcpGatewaySessionHandler
+	sessions map[uint32]*TcpGatewaySession
+	mutex    sync.RWMutex
+}
+
+//
+// 创建一个按会话处理客户端的网关后端，参数跟'NewTcpGatewayBackend'一样，区别是客户端的接入、消息和断开分别交给'handler'处理。
+// 网关前端在客户端接入和断开时会发送专门的通知，所以不会把客户端发送的空消息包误认为断开。
+//
+func NewTcpGatewaySessionBackend(addr string, pack int, memPool MemPool, handler TcpGatewaySessionHandler, opts ...TcpOption) (*TcpGatewayBackend, error) {
+	var sessions = &tcpGatewaySessions{
+		handler:  handler,
+		sessions: make(map[uint32]*TcpGatewaySession),
+	}
+
+	return newTcpGatewayBackend(addr, pack, memPool, sessions.handle, sessions, opts)
+}
+
+//
+// 返回客户端ID对应的会话，客户端不在线时返回nil，只对'NewTcpGatewaySessionBackend'创建的网关后端有效。
+//
+func (this *TcpGatewayBackend) Session(clientId uint32) *TcpGatewaySession {
+	if this.sessions == nil {
+		return nil
+	}
+
+	this.sessions.mutex.RLock()
+	defer this.sessions.mutex.RUnlock()
+
+	return this.sessions.sessions[clientId]
+}
+
+//
+// 返回在线的会话数量，只对'NewTcpGatewaySessionBackend'创建的网关后端有效。
+//
+func (this *TcpGatewayBackend) SessionCount() int {
+	if this.sessions == nil {
+		return 0
+	}
+
+	this.sessions.mutex.RLock()
+	defer this.sessions.mutex.RUnlock()
+
+	return len(this.sessions.sessions)
+}
+
+func (this *tcpGatewaySessions) get(clientId uint32) *TcpGatewaySession {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return this.sessions[clientId]
+}
+
+func (this *tcpGatewaySessions) handle(msg *TcpGatewayIntput) {
+	// 网关后端关闭时所有会话已经随着连接断开结束了
+	if msg == nil {
+		return
+	}
+
+	// 没有对应会话的客户端直接忽略，例如会话已经被网关后端关闭以后还在路上的消息包
+	if session := this.get(msg.ClientId); session != nil {
+		this.handler.OnMessage(session, msg.TcpInput)
+	}
+}
+
+func (this *tcpGatewaySessions) add(session *TcpGatewaySession) {
+	this.mutex.Lock()
+	this.sessions[session.id] = session
+	this.mutex.Unlock()
+
+	this.handler.OnConnect(session)
+}
+
+func (this *tcpGatewaySessions) remove(clientId uint32, reason error) {
+	this.mutex.Lock()
+
+	var session, exists = this.sessions[clientId]
+
+	delete(this.sessions, clientId)
+
+	this.mutex.Unlock()
+
+	if exists {
+		this.handler.OnDisconnect(session, reason)
+	}
+}
+
+//
+// 跟网关前端的连接断开以后，这个连接上的客户端都已经不在了。
+//
+func (this *tcpGatewaySessions) linkClosed(linkId uint32, err error) {
+	if backendErr := this.backend.Err(); backendErr != nil {
+		err = backendErr
+	} else if err == nil {
+		err = ErrConnClosed
+	}
+
+	var closed []*TcpGatewaySession
+
+	this.mutex.Lock()
+
+	for id, session := range this.sessions {
+		if uint32(this.backend.linkId(id)) == linkId {
+			closed = append(closed, session)
+			delete(this.sessions, id)
+		}
+	}
+
+	this.mutex.Unlock()
+
+	for _, session := range closed {
+		this.handler.OnDisconnect(session, err)
+	}
+}
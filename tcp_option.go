@@ -0,0 +1,342 @@
+package tcputil
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	_HANDSHAKE_TIMEOUT_   = 10 * time.Second
+	_RECONNECT_MIN_DELAY_ = 500 * time.Millisecond
+	_RECONNECT_MAX_DELAY_ = 30 * time.Second
+)
+
+//
+// 可选参数，作为'NewTcpListener'、'Listen'、'NewTcpConn'、'Connect'等函数的最后一个可变参数传入。
+//
+type TcpOption func(config *tcpConfig)
+
+type tcpConfig struct {
+	order         binary.ByteOrder
+	framer        TcpFramer
+	sendQueueSize int
+	sendPolicy    TcpSendPolicy
+
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	linkEvent         func(event *TcpGatewayLinkEvent)
+	reconnectMin      time.Duration
+	reconnectMax      time.Duration
+	safeInput         bool
+	frontendId        uint32
+	linkBits          int
+	balancers         map[uint32]TcpGatewayBalancer
+	gatewayKey        []byte
+
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+	localAddr   string
+	reusePort   bool
+}
+
+func newTcpConfig(opts []TcpOption) tcpConfig {
+	var config = tcpConfig{
+		order:         binary.LittleEndian,
+		sendQueueSize: _SEND_QUEUE_SIZE_,
+		sendPolicy:    TcpSendBlock,
+
+		handshakeTimeout: _HANDSHAKE_TIMEOUT_,
+
+		reconnectMin: _RECONNECT_MIN_DELAY_,
+		reconnectMax: _RECONNECT_MAX_DELAY_,
+
+		linkBits: _GATEWAY_LINK_BITS_,
+	}
+
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// 返回连接使用的分帧方式，没有通过'WithFramer'设置时使用'pack'字节长度的头部
+func (this *tcpConfig) newFramer(pack int) (TcpFramer, error) {
+	if this.framer != nil {
+		return this.framer, nil
+	}
+
+	return NewTcpHeadFramer(pack, this.order)
+}
+
+// 网关前端和网关后端之间的连接固定使用'pack'字节长度的头部，'WithFramer'只作用于客户端。
+// 超时、发送策略和安全模式也只作用于客户端，一个连接上有很多客户端，连接是否存活只由心跳和握手超时决定
+func (this *tcpConfig) linkConfig() tcpConfig {
+	var config = *this
+
+	config.framer = nil
+	config.readTimeout = 0
+	config.idleTimeout = 0
+	config.writeTimeout = 0
+	config.sendPolicy = TcpSendBlock
+	config.safeInput = false
+
+	return config
+}
+
+func (this *tcpConfig) dialer() (*net.Dialer, error) {
+	var dialer = &net.Dialer{
+		Timeout:   this.dialTimeout,
+		KeepAlive: this.keepAlive,
+	}
+
+	if this.localAddr != "" {
+		var localAddr, err = net.ResolveTCPAddr("tcp", this.localAddr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.LocalAddr = localAddr
+	}
+
+	if this.reusePort {
+		dialer.Control = reusePortControl
+	}
+
+	return dialer, nil
+}
+
+func (this *tcpConfig) listenConfig() *net.ListenConfig {
+	var config = &net.ListenConfig{
+		KeepAlive: this.keepAlive,
+	}
+
+	if this.reusePort {
+		config.Control = reusePortControl
+	}
+
+	return config
+}
+
+func (this *tcpConfig) heartbeatTimeout() time.Duration {
+	return this.heartbeatInterval * time.Duration(this.heartbeatMisses)
+}
+
+func (this *tcpConfig) emitLinkEvent(id uint32, addr string, up bool, err error) {
+	if this.linkEvent != nil {
+		this.linkEvent(&TcpGatewayLinkEvent{id, addr, up, err})
+	}
+}
+
+//
+// 设置消息包头部的长度信息以及TcpInput和TcpOutput读写数值时使用的字节序，默认是小端格式。
+// 通讯的两端必须使用同样的字节序，网关前端和网关后端之间也一样。
+//
+func WithByteOrder(order binary.ByteOrder) TcpOption {
+	return func(config *tcpConfig) {
+		if order != nil {
+			config.order = order
+		}
+	}
+}
+
+//
+// 设置消息包的分帧方式，设置以后'pack'参数不再用于分割消息包，请参考'TcpFramer'。
+// 对网关来说只作用于网关前端和客户端之间的连接，网关前端和网关后端之间仍然使用'pack'字节长度的头部，网关后端也要设置同样的分帧方式。
+//
+func WithFramer(framer TcpFramer) TcpOption {
+	return func(config *tcpConfig) {
+		config.framer = framer
+	}
+}
+
+//
+// 设置发送队列的长度和队列满了以后的处理策略，默认队列长度是128，队列满时阻塞发送者。
+//
+func WithSendQueue(size int, policy TcpSendPolicy) TcpOption {
+	return func(config *tcpConfig) {
+		if size > 0 {
+			config.sendQueueSize = size
+		}
+		config.sendPolicy = policy
+	}
+}
+
+//
+// 设置读取一个消息包允许的最长时间，从消息包的第一个字节到达时算起，超时以后连接会被关闭，默认不限制。
+// 等待消息包到达的时间不受这个设置限制，请参考'WithIdleTimeout'。
+//
+func WithReadTimeout(timeout time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.readTimeout = timeout
+	}
+}
+
+//
+// 设置写出一批消息包允许的最长时间，超时通常意味着对方已经失去响应，连接会被关闭，默认不限制。
+// 超时以后'TcpConn.Err'返回ErrWriteTimeout，之后发送消息包都返回ErrConnClosed。
+//
+func WithWriteTimeout(timeout time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.writeTimeout = timeout
+	}
+}
+
+//
+// 设置连接空闲的最长时间，超过这个时间没有收到新的消息包，连接会被关闭，默认不限制。
+//
+func WithIdleTimeout(timeout time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.idleTimeout = timeout
+	}
+}
+
+//
+// 设置网关前端等待新客户端发送后端ID的最长时间，超时以后客户端连接会被关闭，默认是10秒，设置为0表示不限制。
+//
+func WithHandshakeTimeout(timeout time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.handshakeTimeout = timeout
+	}
+}
+
+//
+// 设置网关前端和网关后端之间的心跳，每隔'interval'发送一次心跳包，连续'misses'个间隔没有收到对方的任何消息包就断开连接。
+// 只对'NewTcpGatewayFrontend'和'NewTcpGatewayBackend'有效，默认不开启，但不管是否开启都会回应对方的心跳包。
+//
+func WithHeartbeat(interval time.Duration, misses int) TcpOption {
+	return func(config *tcpConfig) {
+		if misses < 1 {
+			misses = 1
+		}
+		config.heartbeatInterval = interval
+		config.heartbeatMisses = misses
+	}
+}
+
+//
+// 设置网关连接状态变化的回调，连接建立和断开时都会被调用，可以用于监控报警。
+// 只对'NewTcpGatewayFrontend'和'NewTcpGatewayBackend'有效，回调可能在不同的协程中被同时调用。
+//
+func WithGatewayLinkEvent(callback func(event *TcpGatewayLinkEvent)) TcpOption {
+	return func(config *tcpConfig) {
+		config.linkEvent = callback
+	}
+}
+
+//
+// 设置网关前端的ID，客户端接入时随客户端信息一起发给网关后端，用于区分客户端来自哪个网关前端，默认是0。
+// 只对'NewTcpGatewayFrontend'有效，请参考'TcpGatewaySession.FrontendId'。
+//
+func WithGatewayFrontendId(id uint32) TcpOption {
+	return func(config *tcpConfig) {
+		config.frontendId = id
+	}
+}
+
+//
+// 设置后端分组选择后端的策略，没有设置的分组使用'NewTcpRoundRobinBalancer'。
+// 只对'NewTcpGatewayFrontend'有效，可以多次使用来设置不同的分组，请参考'TcpGatewayBackendInfo.Group'。
+//
+func WithGatewayBalancer(group uint32, balancer TcpGatewayBalancer) TcpOption {
+	return func(config *tcpConfig) {
+		if config.balancers == nil {
+			config.balancers = make(map[uint32]TcpGatewayBalancer)
+		}
+		config.balancers[group] = balancer
+	}
+}
+
+//
+// 设置连接网关时随后端ID一起发送的键，网关前端按分组选择后端时交给'TcpGatewayBalancer'，例如用户ID，让同一个用户总是连到同一个后端。
+// 没有设置时网关前端使用客户端的IP地址。只对'ConnectGateway'有效。
+//
+func WithGatewayKey(key []byte) TcpOption {
+	return func(config *tcpConfig) {
+		config.gatewayKey = key
+	}
+}
+
+//
+// 设置客户端ID中用来存放网关前端连接序号的高位位数，剩下的低位用来区分同一个网关前端的客户端。
+// 默认是8位，最多256个网关前端，每个网关前端同时最多16777215个客户端。'bits'的范围是1到16，超出范围时取最接近的值。
+// 只对'NewTcpGatewayBackend'有效，网关前端在连接时从后端获取这个设置，不需要另外配置。
+//
+func WithGatewayLinkBits(bits int) TcpOption {
+	return func(config *tcpConfig) {
+		if bits < _GATEWAY_MIN_LINK_BITS_ {
+			bits = _GATEWAY_MIN_LINK_BITS_
+		}
+		if bits > _GATEWAY_MAX_LINK_BITS_ {
+			bits = _GATEWAY_MAX_LINK_BITS_
+		}
+		config.linkBits = bits
+	}
+}
+
+//
+// 设置网关前端重连后端的等待时间，第一次重连等待'minDelay'，之后每次失败等待时间加倍，最多等待'maxDelay'，实际等待时间会在一半到全部之间随机抖动。
+// 默认是0.5秒到30秒，'minDelay'设置为0表示不自动重连。只对'NewTcpGatewayFrontend'有效。
+//
+func WithReconnect(minDelay, maxDelay time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		if maxDelay < minDelay {
+			maxDelay = minDelay
+		}
+		config.reconnectMin = minDelay
+		config.reconnectMax = maxDelay
+	}
+}
+
+//
+// 让'ReadInput'、'ReadPackage'返回的TcpInput，以及网关后端交给'messageHeandler'的消息都使用安全模式，请参考'TcpInput.Safe'。
+//
+func WithSafeInput() TcpOption {
+	return func(config *tcpConfig) {
+		config.safeInput = true
+	}
+}
+
+//
+// 设置'DialContext'、'ConnectGatewayContext'等函数建立连接的超时时间，默认不限制。
+// 网关前端连接后端时，如果没有设置这个选项，会使用10秒的超时时间，避免一个连不上的后端卡住'UpdateBackends'。
+//
+func WithDialTimeout(timeout time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.dialTimeout = timeout
+	}
+}
+
+//
+// 设置TCP层的keepalive探测间隔，默认使用Go标准库的设置，设置为负数表示关闭。
+//
+func WithKeepAlive(interval time.Duration) TcpOption {
+	return func(config *tcpConfig) {
+		config.keepAlive = interval
+	}
+}
+
+//
+// 设置建立连接时使用的本地地址，格式跟'Connect'的地址参数一样，端口可以是0。
+//
+func WithLocalAddr(addr string) TcpOption {
+	return func(config *tcpConfig) {
+		config.localAddr = addr
+	}
+}
+
+//
+// 设置SO_REUSEPORT，让多个进程可以监听同一个端口，由内核负责分配新进连接，只在支持这个选项的系统上有效，其他系统上监听会失败。
+//
+func WithReusePort(reusePort bool) TcpOption {
+	return func(config *tcpConfig) {
+		config.reusePort = reusePort
+	}
+}
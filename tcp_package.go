@@ -1,20 +1,125 @@
 package tcputil
 
 import (
-	"reflect"
-	"unsafe"
+	"encoding/binary"
+	"math"
 )
 
 type TcpOutput struct {
 	owner *TcpConn
 	buff  []byte
 	Data  []byte
+	order binary.ByteOrder
+
+	// 以下字段只在'NewBuilder'创建的构建模式下使用
+	builder bool
+	head    int   // buff中为帧头部预留的字节数，消息内容从这里开始
+	err     error // 扩容失败的原因，由'Send'返回
+
+	// 广播包的消息内容，'Send'交给广播实例按网关前端分别发送
+	broadcast *TcpBroadcast
 }
 
+//
+// 发送消息包，构建模式下会先根据实际写入的长度填写帧头部和尾部。
+// 消息包只是放进发送队列，由发送协程在后台写出，所以写出失败不会由这次调用返回。
+// 后台写出失败以后连接会被断开，之后的'Send'都返回ErrConnClosed，断开的原因可以通过'TcpConn.Err'获取。
+//
 func (this *TcpOutput) Send() error {
+	if this.broadcast != nil {
+		return this.broadcast.Send()
+	}
+
+	if this.builder {
+		return this.sendBuilder()
+	}
+
 	return this.owner.sendRaw(this.buff)
 }
 
+// 确保剩余空间至少有'n'字节，构建模式下空间不够时自动扩容，否则视为调用者计算长度出错
+func (this *TcpOutput) ensure(n int) {
+	if len(this.Data) >= n {
+		return
+	}
+
+	if !this.builder {
+		panic("index out of range")
+	}
+
+	this.grow(n)
+}
+
+//
+// 构建模式下扩容，新内存同样从内存池申请，旧内存还给内存池。
+// 超过内存池允许的长度时记录错误，之后写入的内容都被丢弃，'Send'返回ErrPacketTooLarge。
+//
+func (this *TcpOutput) grow(n int) {
+	if this.err != nil {
+		this.Data = make([]byte, n)
+		return
+	}
+
+	var (
+		used = len(this.buff) - len(this.Data)
+		size = 2 * len(this.buff)
+	)
+
+	if size < used+n {
+		size = used + n
+	}
+
+	var buff = this.owner.memPool.Alloc(size)
+
+	if buff == nil {
+		if buff = this.owner.memPool.Alloc(used + n); buff == nil {
+			this.err = ErrPacketTooLarge
+			this.Data = make([]byte, n)
+			return
+		}
+	}
+
+	copy(buff, this.buff[:used])
+
+	this.owner.Free(this.buff)
+
+	this.buff, this.Data = buff, buff[used:]
+}
+
+func (this *TcpOutput) sendBuilder() error {
+	if this.err != nil {
+		return this.err
+	}
+
+	var size = len(this.buff) - len(this.Data) - this.head
+	var head, tail, err = this.owner.framer.FrameSize(size)
+
+	if err != nil {
+		return err
+	}
+
+	// 预留的头部不够，或者尾部放不下，只能换一块内存
+	if head > this.head || tail > len(this.Data) {
+		var buff = this.owner.memPool.Alloc(head + size + tail)
+
+		if buff == nil {
+			return ErrPacketTooLarge
+		}
+
+		copy(buff[head:], this.buff[this.head:this.head+size])
+
+		this.owner.Free(this.buff)
+
+		this.buff, this.head, this.Data = buff, head, buff[head+size:]
+	}
+
+	var frame = this.buff[this.head-head : this.head+size+tail]
+
+	this.owner.framer.EncodeFrame(frame, size)
+
+	return this.owner.sendRaw(frame)
+}
+
 func (this *TcpOutput) WriteUint(pack int, value uint64) *TcpOutput {
 	switch pack {
 	case 1:
@@ -33,81 +138,63 @@ func (this *TcpOutput) WriteUint(pack int, value uint64) *TcpOutput {
 }
 
 func (this *TcpOutput) WriteInt8(value int8) *TcpOutput {
-	if len(this.Data) < 1 {
-		panic("index out of range")
-	}
+	this.ensure(1)
 	this.Data[0] = byte(value)
 	this.Data = this.Data[1:]
 	return this
 }
 
 func (this *TcpOutput) WriteUint8(value uint8) *TcpOutput {
-	if len(this.Data) < 1 {
-		panic("index out of range")
-	}
+	this.ensure(1)
 	this.Data[0] = byte(value)
 	this.Data = this.Data[1:]
 	return this
 }
 
 func (this *TcpOutput) WriteInt16(value int16) *TcpOutput {
-	if len(this.Data) < 2 {
-		panic("index out of range")
-	}
-	*(*int16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(2)
+	this.order.PutUint16(this.Data, uint16(value))
 	this.Data = this.Data[2:]
 	return this
 }
 
 func (this *TcpOutput) WriteUint16(value uint16) *TcpOutput {
-	if len(this.Data) < 2 {
-		panic("index out of range")
-	}
-	*(*uint16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(2)
+	this.order.PutUint16(this.Data, value)
 	this.Data = this.Data[2:]
 	return this
 }
 
 func (this *TcpOutput) WriteInt32(value int32) *TcpOutput {
-	if len(this.Data) < 4 {
-		panic("index out of range")
-	}
-	*(*int32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(4)
+	this.order.PutUint32(this.Data, uint32(value))
 	this.Data = this.Data[4:]
 	return this
 }
 
 func (this *TcpOutput) WriteUint32(value uint32) *TcpOutput {
-	if len(this.Data) < 4 {
-		panic("index out of range")
-	}
-	*(*uint32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(4)
+	this.order.PutUint32(this.Data, value)
 	this.Data = this.Data[4:]
 	return this
 }
 
 func (this *TcpOutput) WriteInt64(value int64) *TcpOutput {
-	if len(this.Data) < 8 {
-		panic("index out of range")
-	}
-	*(*int64)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(8)
+	this.order.PutUint64(this.Data, uint64(value))
 	this.Data = this.Data[8:]
 	return this
 }
 
 func (this *TcpOutput) WriteUint64(value uint64) *TcpOutput {
-	if len(this.Data) < 8 {
-		panic("index out of range")
-	}
-	*(*uint64)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data)) = value
+	this.ensure(8)
+	this.order.PutUint64(this.Data, value)
 	this.Data = this.Data[8:]
 	return this
 }
 
 func (this *TcpOutput) WriteBytes(data []byte) *TcpOutput {
-	if len(this.Data) < len(data) {
-		panic("index out of range")
-	}
+	this.ensure(len(data))
 	copy(this.Data, data)
 	this.Data = this.Data[len(data):]
 	return this
@@ -131,86 +218,218 @@ func (this *TcpOutput) WriteBytes32(data []byte) *TcpOutput {
 	return this
 }
 
+func (this *TcpOutput) WriteString(data string) *TcpOutput {
+	this.ensure(len(data))
+	copy(this.Data, data)
+	this.Data = this.Data[len(data):]
+	return this
+}
+
+func (this *TcpOutput) WriteString8(data string) *TcpOutput {
+	this.WriteUint8(uint8(len(data)))
+	this.WriteString(data)
+	return this
+}
+
+func (this *TcpOutput) WriteString16(data string) *TcpOutput {
+	this.WriteUint16(uint16(len(data)))
+	this.WriteString(data)
+	return this
+}
+
+func (this *TcpOutput) WriteString32(data string) *TcpOutput {
+	this.WriteUint32(uint32(len(data)))
+	this.WriteString(data)
+	return this
+}
+
+func (this *TcpOutput) WriteBool(value bool) *TcpOutput {
+	if value {
+		return this.WriteUint8(1)
+	}
+	return this.WriteUint8(0)
+}
+
+func (this *TcpOutput) WriteFloat32(value float32) *TcpOutput {
+	return this.WriteUint32(math.Float32bits(value))
+}
+
+func (this *TcpOutput) WriteFloat64(value float64) *TcpOutput {
+	return this.WriteUint64(math.Float64bits(value))
+}
+
+//
+// 写入protobuf风格的varint，长度是1到10个字节，可以用'UvarintSize'计算，varint的格式跟字节序设置无关。
+//
+func (this *TcpOutput) WriteUvarint(value uint64) *TcpOutput {
+	var n = UvarintSize(value)
+	this.ensure(n)
+	binary.PutUvarint(this.Data, value)
+	this.Data = this.Data[n:]
+	return this
+}
+
+//
+// 写入zigzag编码的有符号varint，绝对值小的负数也只需要很少的字节，长度可以用'VarintSize'计算。
+//
+func (this *TcpOutput) WriteVarint(value int64) *TcpOutput {
+	return this.WriteUvarint(uint64(value<<1) ^ uint64(value>>63))
+}
+
+//
+// 返回'WriteUvarint'写入'value'需要的字节数
+//
+func UvarintSize(value uint64) int {
+	var n = 1
+
+	for ; value >= 0x80; value >>= 7 {
+		n++
+	}
+
+	return n
+}
+
+//
+// 返回'WriteVarint'写入'value'需要的字节数
+//
+func VarintSize(value int64) int {
+	return UvarintSize(uint64(value<<1) ^ uint64(value>>63))
+}
+
 type TcpInput struct {
-	Data []byte
+	Data  []byte
+	order binary.ByteOrder
+	safe  bool
+	err   error
 }
 
 func NewTcpInput(data []byte) *TcpInput {
-	return &TcpInput{data}
+	return &TcpInput{Data: data, order: binary.LittleEndian}
+}
+
+func NewTcpInputWithOrder(data []byte, order binary.ByteOrder) *TcpInput {
+	return &TcpInput{Data: data, order: order}
+}
+
+//
+// 切换到安全模式，读取超出剩余数据时不再panic，而是记录ErrInputTooShort并返回零值，之后的读取也都返回零值。
+// 解析来自不可信对端的消息包时建议使用，解析完成后通过'Err'检查一次就可以。
+//
+func (this *TcpInput) Safe() *TcpInput {
+	this.safe = true
+	return this
+}
+
+//
+// 返回安全模式下第一次读取出错的原因，没有出错时返回nil。
+//
+func (this *TcpInput) Err() error {
+	return this.err
+}
+
+// 检查剩余数据是否够'n'字节，不够时安全模式下记录错误并返回false，否则视为调用者的错误直接panic
+func (this *TcpInput) check(n int) bool {
+	if this.err == nil && n >= 0 && len(this.Data) >= n {
+		return true
+	}
+
+	if !this.safe {
+		panic("index out of range")
+	}
+
+	if this.err == nil {
+		this.err = ErrInputTooShort
+	}
+
+	this.Data = this.Data[len(this.Data):]
+
+	return false
 }
 
 func (this *TcpInput) Seek(n int) *TcpInput {
+	if !this.check(n) {
+		return this
+	}
 	this.Data = this.Data[n:]
 	return this
 }
 
 func (this *TcpInput) ReadInt8() int8 {
+	if !this.check(1) {
+		return 0
+	}
 	var result = int8(this.Data[0])
 	this.Data = this.Data[1:]
 	return result
 }
 
 func (this *TcpInput) ReadUint8() uint8 {
+	if !this.check(1) {
+		return 0
+	}
 	var result = uint8(this.Data[0])
 	this.Data = this.Data[1:]
 	return result
 }
 
 func (this *TcpInput) ReadInt16() int16 {
-	if len(this.Data) < 2 {
-		panic("index out of range")
+	if !this.check(2) {
+		return 0
 	}
-	var result = *(*int16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = int16(this.order.Uint16(this.Data))
 	this.Data = this.Data[2:]
 	return result
 }
 
 func (this *TcpInput) ReadUint16() uint16 {
-	if len(this.Data) < 2 {
-		panic("index out of range")
+	if !this.check(2) {
+		return 0
 	}
-	var result = *(*uint16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = this.order.Uint16(this.Data)
 	this.Data = this.Data[2:]
 	return result
 }
 
 func (this *TcpInput) ReadInt32() int32 {
-	if len(this.Data) < 4 {
-		panic("index out of range")
+	if !this.check(4) {
+		return 0
 	}
-	var result = *(*int32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = int32(this.order.Uint32(this.Data))
 	this.Data = this.Data[4:]
 	return result
 }
 
 func (this *TcpInput) ReadUint32() uint32 {
-	if len(this.Data) < 4 {
-		panic("index out of range")
+	if !this.check(4) {
+		return 0
 	}
-	var result = *(*uint32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = this.order.Uint32(this.Data)
 	this.Data = this.Data[4:]
 	return result
 }
 
 func (this *TcpInput) ReadInt64() int64 {
-	if len(this.Data) < 8 {
-		panic("index out of range")
+	if !this.check(8) {
+		return 0
 	}
-	var result = *(*int64)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = int64(this.order.Uint64(this.Data))
 	this.Data = this.Data[8:]
 	return result
 }
 
 func (this *TcpInput) ReadUint64() uint64 {
-	if len(this.Data) < 8 {
-		panic("index out of range")
+	if !this.check(8) {
+		return 0
 	}
-	var result = *(*uint64)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&this.Data)).Data))
+	var result = this.order.Uint64(this.Data)
 	this.Data = this.Data[8:]
 	return result
 }
 
 func (this *TcpInput) ReadBytes(n int) []byte {
+	if !this.check(n) {
+		return nil
+	}
 	var result = this.Data[:n]
 	this.Data = this.Data[n:]
 	return result
@@ -230,3 +449,177 @@ func (this *TcpInput) ReadBytes32() []byte {
 	var n = this.ReadUint32()
 	return this.ReadBytes(int(n))
 }
+
+func (this *TcpInput) ReadString(n int) string {
+	return string(this.ReadBytes(n))
+}
+
+func (this *TcpInput) ReadString8() string {
+	return string(this.ReadBytes8())
+}
+
+func (this *TcpInput) ReadString16() string {
+	return string(this.ReadBytes16())
+}
+
+func (this *TcpInput) ReadString32() string {
+	return string(this.ReadBytes32())
+}
+
+func (this *TcpInput) ReadBool() bool {
+	return this.ReadUint8() != 0
+}
+
+func (this *TcpInput) ReadFloat32() float32 {
+	return math.Float32frombits(this.ReadUint32())
+}
+
+func (this *TcpInput) ReadFloat64() float64 {
+	return math.Float64frombits(this.ReadUint64())
+}
+
+//
+// 读取'WriteUvarint'写入的varint，数据不完整或者超过64位时跟其他读取方法一样处理。
+//
+func (this *TcpInput) ReadUvarint() uint64 {
+	if this.err != nil {
+		return 0
+	}
+
+	var result, n = binary.Uvarint(this.Data)
+
+	if n <= 0 {
+		// n == 0 表示数据不完整，n < 0 表示超过64位，都按数据不完整处理
+		this.check(len(this.Data) + 1)
+		return 0
+	}
+
+	this.Data = this.Data[n:]
+	return result
+}
+
+func (this *TcpInput) ReadVarint() int64 {
+	var value = this.ReadUvarint()
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+// 'Peek'系列方法读取数据但不移动读取位置，数据不够时跟对应的'Read'方法一样处理
+
+// 恢复读取位置，已经出错时保持出错的状态
+func (this *TcpInput) unread(data []byte) {
+	if this.err == nil {
+		this.Data = data
+	}
+}
+
+func (this *TcpInput) PeekInt8() int8 {
+	var data = this.Data
+	var result = this.ReadInt8()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekUint8() uint8 {
+	var data = this.Data
+	var result = this.ReadUint8()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekInt16() int16 {
+	var data = this.Data
+	var result = this.ReadInt16()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekUint16() uint16 {
+	var data = this.Data
+	var result = this.ReadUint16()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekInt32() int32 {
+	var data = this.Data
+	var result = this.ReadInt32()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekUint32() uint32 {
+	var data = this.Data
+	var result = this.ReadUint32()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekInt64() int64 {
+	var data = this.Data
+	var result = this.ReadInt64()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekUint64() uint64 {
+	var data = this.Data
+	var result = this.ReadUint64()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekBool() bool {
+	var data = this.Data
+	var result = this.ReadBool()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekFloat32() float32 {
+	var data = this.Data
+	var result = this.ReadFloat32()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekFloat64() float64 {
+	var data = this.Data
+	var result = this.ReadFloat64()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekUvarint() uint64 {
+	var data = this.Data
+	var result = this.ReadUvarint()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekVarint() int64 {
+	var data = this.Data
+	var result = this.ReadVarint()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekString8() string {
+	var data = this.Data
+	var result = this.ReadString8()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekString16() string {
+	var data = this.Data
+	var result = this.ReadString16()
+	this.unread(data)
+	return result
+}
+
+func (this *TcpInput) PeekString32() string {
+	var data = this.Data
+	var result = this.ReadString32()
+	this.unread(data)
+	return result
+}
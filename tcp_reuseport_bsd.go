@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcputil
+
+import (
+	"syscall"
+)
+
+const (
+	_SO_REUSEPORT_ = syscall.SO_REUSEPORT
+)
@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package tcputil
+
+// syscall包在linux下没有定义SO_REUSEPORT，mips架构的取值跟其他架构不一样
+const (
+	_SO_REUSEPORT_ = 0x200
+)
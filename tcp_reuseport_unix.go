@@ -0,0 +1,19 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcputil
+
+import (
+	"syscall"
+)
+
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	var err error
+
+	if err2 := conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, _SO_REUSEPORT_, 1)
+	}); err2 != nil {
+		return err2
+	}
+
+	return err
+}
@@ -0,0 +1,256 @@
+package tcputil
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// 没有找到处理函数时回复的消息ID，消息内容是收到的消息ID(2)
+	TcpUnknownMessageId uint16 = 0xFFFF
+)
+
+//
+// 可以从TcpInput解码的消息类型，tcputil-gen生成的UnmarshalFrom方法满足这个接口
+//
+type TcpUnmarshaler interface {
+	UnmarshalFrom(in *TcpInput) error
+}
+
+//
+// 可以编码到TcpOutput的消息类型，tcputil-gen生成的Size和MarshalTo方法满足这个接口
+//
+type TcpMarshaler interface {
+	Size() int
+	MarshalTo(out *TcpOutput) *TcpOutput
+}
+
+//
+// 路由到处理函数的一个消息包。
+// 消息包的前两个字节是消息ID，'Input'是去掉消息ID以后的内容，使用安全模式，解析完请检查'Input.Err'。
+//
+type TcpRequest struct {
+	Id       uint16
+	Input    *TcpInput
+	ClientId uint32 // 来自网关后端时是客户端ID，来自普通连接时是0
+
+	conn    *TcpConn
+	backend *TcpGatewayBackend
+}
+
+//
+// 创建一个回复给消息发送方的消息包，内容以消息ID开头，对方已经断开等情况下返回nil。
+//
+func (this *TcpRequest) NewReply(id uint16, size int) *TcpOutput {
+	var output *TcpOutput
+
+	if this.backend != nil {
+		output = this.backend.NewPackage(this.ClientId, 2+size)
+	} else {
+		output = this.conn.NewPackage(2 + size)
+	}
+
+	if output == nil {
+		return nil
+	}
+
+	return output.WriteUint16(id)
+}
+
+//
+// 把'msg'编码以后回复给消息发送方。
+//
+func (this *TcpRequest) Reply(id uint16, msg TcpMarshaler) error {
+	var output = this.NewReply(id, msg.Size())
+
+	if output == nil {
+		return ErrConnClosed
+	}
+
+	return msg.MarshalTo(output).Send()
+}
+
+//
+// 消息处理函数，返回错误时普通连接会被断开，网关客户端会被移除，请参考'TcpRouter.Serve'和'TcpRouter.GatewayHandler'。
+//
+type TcpHandler func(req *TcpRequest) error
+
+//
+// 中间件，包装一个处理函数并返回新的处理函数，可以用于日志、错误恢复、权限检查等。
+//
+type TcpMiddleware func(next TcpHandler) TcpHandler
+
+//
+// 按消息ID把消息包分派给不同的处理函数，可以用于普通连接的读取循环，也可以作为网关后端的消息处理函数。
+// 注册处理函数和中间件可以在任何时候进行，但通常应该在开始处理消息之前完成。
+//
+type TcpRouter struct {
+	mutex       sync.RWMutex
+	handlers    map[uint16]TcpHandler
+	chains      map[uint16]TcpHandler // 包装了中间件的处理函数
+	unknown     TcpHandler
+	unknownRaw  TcpHandler
+	middlewares []TcpMiddleware
+}
+
+func NewTcpRouter() *TcpRouter {
+	return &TcpRouter{
+		handlers:   make(map[uint16]TcpHandler),
+		chains:     make(map[uint16]TcpHandler),
+		unknown:    replyUnknown,
+		unknownRaw: replyUnknown,
+	}
+}
+
+// 默认的未知消息处理，回复TcpUnknownMessageId并带上收到的消息ID
+func replyUnknown(req *TcpRequest) error {
+	if output := req.NewReply(TcpUnknownMessageId, 2); output != nil {
+		output.WriteUint16(req.Id).Send()
+	}
+
+	return nil
+}
+
+func (this *TcpRouter) chain(handler TcpHandler) TcpHandler {
+	for i := len(this.middlewares) - 1; i >= 0; i-- {
+		handler = this.middlewares[i](handler)
+	}
+
+	return handler
+}
+
+//
+// 添加中间件，先添加的在外层，对已经注册的处理函数同样有效。
+//
+func (this *TcpRouter) Use(middlewares ...TcpMiddleware) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.middlewares = append(this.middlewares, middlewares...)
+
+	for id, handler := range this.handlers {
+		this.chains[id] = this.chain(handler)
+	}
+
+	this.unknown = this.chain(this.unknownRaw)
+}
+
+//
+// 注册消息ID对应的处理函数，同一个ID重复注册时后注册的生效。
+//
+func (this *TcpRouter) Handle(id uint16, handler TcpHandler) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.handlers[id] = handler
+	this.chains[id] = this.chain(handler)
+}
+
+//
+// 注册消息ID对应的处理函数，消息内容先用'newMsg'创建的实例解码，解码失败时返回错误，不会调用'handler'。
+//
+func (this *TcpRouter) HandleMessage(id uint16, newMsg func() TcpUnmarshaler, handler func(req *TcpRequest, msg TcpUnmarshaler) error) {
+	this.Handle(id, func(req *TcpRequest) error {
+		var msg = newMsg()
+
+		if err := msg.UnmarshalFrom(req.Input); err != nil {
+			return err
+		}
+
+		if err := req.Input.Err(); err != nil {
+			return err
+		}
+
+		return handler(req, msg)
+	})
+}
+
+//
+// 设置没有找到处理函数时的处理方式，默认回复一个消息ID为TcpUnknownMessageId的消息包，内容是收到的消息ID。
+//
+func (this *TcpRouter) HandleUnknown(handler TcpHandler) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.unknownRaw = handler
+	this.unknown = this.chain(handler)
+}
+
+//
+// 把一个消息包分派给对应的处理函数，返回处理函数的错误。
+//
+func (this *TcpRouter) Dispatch(req *TcpRequest) error {
+	this.mutex.RLock()
+
+	var handler, exists = this.chains[req.Id]
+
+	if !exists {
+		handler = this.unknown
+	}
+
+	this.mutex.RUnlock()
+
+	return handler(req)
+}
+
+func (this *TcpRouter) dispatch(input *TcpInput, clientId uint32, conn *TcpConn, backend *TcpGatewayBackend) error {
+	input.Safe()
+
+	var id = input.ReadUint16()
+
+	if err := input.Err(); err != nil {
+		return err
+	}
+
+	return this.Dispatch(&TcpRequest{id, input, clientId, conn, backend})
+}
+
+//
+// 循环读取'conn'上的消息包并分派给处理函数，直到读取出错或者处理函数返回错误，返回的错误就是原因，连接需要调用者关闭。
+//
+func (this *TcpRouter) Serve(conn *TcpConn) error {
+	for {
+		var input, err = conn.ReadInput()
+
+		if err != nil {
+			return err
+		}
+
+		if err = this.dispatch(input, 0, conn, nil); err != nil {
+			return err
+		}
+	}
+}
+
+//
+// 返回一个可以传给'NewTcpGatewayBackend'的消息处理函数，处理函数返回错误时会通知网关前端移除这个客户端。
+// 客户端断开时收到的空消息、开启了TakeClientAddr时的客户端地址消息以及网关后端关闭时收到的nil都会被忽略。
+//
+func (this *TcpRouter) GatewayHandler() func(msg *TcpGatewayIntput) {
+	return func(msg *TcpGatewayIntput) {
+		if msg == nil || len(msg.Data) == 0 || msg.clientAddr {
+			return
+		}
+
+		if err := this.dispatch(msg.TcpInput, msg.ClientId, nil, msg.backend); err != nil {
+			msg.backend.DelClient(msg.ClientId)
+		}
+	}
+}
+
+//
+// 错误恢复中间件，处理函数panic时转换成错误返回，避免一个有问题的消息包让整个进程退出。
+//
+func TcpRecover() TcpMiddleware {
+	return func(next TcpHandler) TcpHandler {
+		return func(req *TcpRequest) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("tcputil: handler panic on message %d: %v", req.Id, r)
+				}
+			}()
+
+			return next(req)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package tcputil
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	_RPC_MESSAGE_ = 0 // 普通消息包，没有请求序号
+	_RPC_REQUEST_ = 1
+	_RPC_REPLY_   = 2
+)
+
+//
+// 在TcpConn上实现请求/应答模式的调用，每个请求带一个序号，应答带回同样的序号，同一个连接上可以同时有多个调用在等待应答。
+// 连接的两端都需要用TcpRpc包装，消息包第一个字节是类型，请求和应答接着是4个字节的序号，然后才是消息内容。
+//
+// TcpRpc创建以后会一直读取连接上的消息包，不能再直接调用连接的读取方法，发送消息包请使用TcpRpc提供的方法。
+//
+type TcpRpc struct {
+	conn    *TcpConn
+	handler func(req *TcpRpcRequest)
+	message func(msg *TcpInput)
+
+	mutex    sync.Mutex
+	seq      uint32
+	pending  map[uint32]chan []byte
+	closeErr error
+}
+
+//
+// 对方发过来的一个请求，'Input'是去掉类型和序号以后的内容，使用安全模式，解析完请检查'Input.Err'。
+//
+type TcpRpcRequest struct {
+	Input *TcpInput
+
+	seq uint32
+	rpc *TcpRpc
+}
+
+//
+// 用TcpRpc包装一个连接并开始读取消息包。
+// 'handler'处理对方的请求，'message'处理对方用'NewMessage'发送的普通消息包，两者都在读取消息包的goroutine中调用，耗时的处理请另开goroutine，应答可以在任何goroutine中发送。
+// 'handler'为nil时忽略所有请求，对方的调用会一直等到超时。连接断开时'message'会收到nil。
+//
+func NewTcpRpc(conn *TcpConn, handler func(req *TcpRpcRequest), message func(msg *TcpInput)) *TcpRpc {
+	var this = &TcpRpc{
+		conn:    conn,
+		handler: handler,
+		message: message,
+		pending: make(map[uint32]chan []byte),
+	}
+
+	go this.readLoop()
+
+	return this
+}
+
+func (this *TcpRpc) readLoop() {
+	for {
+		var data, err = this.conn.ReadPacket()
+
+		if err != nil {
+			// 不再读取的连接也不会再有应答，关闭它让发送协程退出
+			this.conn.Close()
+			this.shutdown(err)
+
+			if this.message != nil {
+				this.message(nil)
+			}
+
+			return
+		}
+
+		var (
+			input = NewTcpInputWithOrder(data, this.conn.order).Safe()
+			kind  = input.ReadUint8()
+			seq   uint32
+		)
+
+		if kind != _RPC_MESSAGE_ {
+			seq = input.ReadUint32()
+		}
+
+		// 不完整的消息包直接丢掉
+		if input.Err() != nil {
+			this.conn.Free(data)
+			continue
+		}
+
+		switch kind {
+		case _RPC_MESSAGE_:
+			if this.message != nil {
+				this.message(input)
+			}
+
+		case _RPC_REQUEST_:
+			if this.handler != nil {
+				this.handler(&TcpRpcRequest{input, seq, this})
+			}
+
+		case _RPC_REPLY_:
+			this.mutex.Lock()
+
+			var reply, exists = this.pending[seq]
+
+			delete(this.pending, seq)
+
+			// 在锁里放进通道，'cancel'拿到锁以后就能确定应答有没有送到
+			if exists {
+				reply <- data
+			}
+
+			this.mutex.Unlock()
+
+			// 调用已经超时或者取消，迟到的应答直接丢掉
+			if !exists {
+				this.conn.Free(data)
+			}
+
+		default:
+			this.conn.Free(data)
+		}
+	}
+}
+
+// 连接断开以后唤醒所有还在等待的调用
+func (this *TcpRpc) shutdown(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.closeErr = err
+
+	for seq, reply := range this.pending {
+		delete(this.pending, seq)
+		close(reply)
+	}
+}
+
+//
+// 发送请求并等待应答，'ctx'超时或者取消时返回'ctx.Err()'，之后才到达的应答会被丢掉。
+// 连接断开时返回断开的原因，请参考'TcpConn.ReadPacket'。返回的TcpInput使用安全模式，解析完请检查'Err'。
+//
+func (this *TcpRpc) Call(ctx context.Context, req TcpMarshaler) (*TcpInput, error) {
+	var output = this.conn.NewPackage(1 + 4 + req.Size())
+
+	if output == nil {
+		return nil, ErrPacketTooLarge
+	}
+
+	var reply = make(chan []byte, 1)
+
+	this.mutex.Lock()
+
+	if this.closeErr != nil {
+		this.mutex.Unlock()
+		return nil, this.closeErr
+	}
+
+	this.seq += 1
+
+	var seq = this.seq
+
+	this.pending[seq] = reply
+
+	this.mutex.Unlock()
+
+	if err := req.MarshalTo(output.WriteUint8(_RPC_REQUEST_).WriteUint32(seq)).Send(); err != nil {
+		this.cancel(seq, reply)
+		return nil, err
+	}
+
+	select {
+	case data, ok := <-reply:
+		if !ok {
+			return nil, this.Err()
+		}
+		// 类型和序号在读取时已经检查过
+		return NewTcpInputWithOrder(data[1+4:], this.conn.order).Safe(), nil
+
+	case <-ctx.Done():
+		this.cancel(seq, reply)
+		return nil, ctx.Err()
+	}
+}
+
+// 放弃等待应答，之后到达的应答会在读取时被丢掉，已经送到的应答还给内存池
+func (this *TcpRpc) cancel(seq uint32, reply chan []byte) {
+	this.mutex.Lock()
+
+	delete(this.pending, seq)
+
+	this.mutex.Unlock()
+
+	select {
+	case data, ok := <-reply:
+		if ok {
+			this.conn.Free(data)
+		}
+	default:
+	}
+}
+
+//
+// 创建一个普通消息包，对方的'message'处理函数会收到它，不需要应答。
+//
+func (this *TcpRpc) NewMessage(size int) *TcpOutput {
+	var output = this.conn.NewPackage(1 + size)
+
+	if output == nil {
+		return nil
+	}
+
+	return output.WriteUint8(_RPC_MESSAGE_)
+}
+
+//
+// 返回还在等待应答的调用数量。
+//
+func (this *TcpRpc) Pending() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return len(this.pending)
+}
+
+//
+// 返回连接断开的原因，连接还没断开时返回nil。
+//
+func (this *TcpRpc) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.closeErr
+}
+
+//
+// 关闭连接，所有还在等待应答的调用会返回错误。
+//
+func (this *TcpRpc) Close() error {
+	return this.conn.Close()
+}
+
+//
+// 创建一个应答消息包，消息包超过内存池允许的长度时返回nil。
+//
+func (this *TcpRpcRequest) NewReply(size int) *TcpOutput {
+	var output = this.rpc.conn.NewPackage(1 + 4 + size)
+
+	if output == nil {
+		return nil
+	}
+
+	return output.WriteUint8(_RPC_REPLY_).WriteUint32(this.seq)
+}
+
+//
+// 把'msg'编码以后作为应答发送。
+//
+func (this *TcpRpcRequest) Reply(msg TcpMarshaler) error {
+	var output = this.NewReply(msg.Size())
+
+	if output == nil {
+		return ErrPacketTooLarge
+	}
+
+	return msg.MarshalTo(output).Send()
+}
@@ -0,0 +1,200 @@
+package tcputil
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	_SEND_QUEUE_SIZE_  = 128
+	_SEND_BATCH_SIZE_  = 64
+	_CLOSE_FLUSH_TIME_ = time.Second
+)
+
+//
+// 发送队列满了以后的处理策略
+//
+type TcpSendPolicy int
+
+const (
+	TcpSendBlock      TcpSendPolicy = iota // 阻塞发送者，直到队列有空位
+	TcpSendDropNewest                      // 丢弃正在发送的消息包，'Send'返回ErrSendQueueFull
+	TcpSendCloseSlow                       // 认为对方处理太慢，直接断开连接，'Send'返回ErrSlowConsumer
+)
+
+type tcpSendItem struct {
+	head    []byte // 可选，在'data'之前写出，用于同一份'data'配上不同头部发给多个连接
+	data    []byte
+	recycle []byte // 写出以后要还给内存池的内存，通常是'data'所在的整块内存
+}
+
+func (this *TcpConn) sendRaw(msg []byte) error {
+	return this.send(tcpSendItem{data: msg})
+}
+
+//
+// 发送消息包，并在写出以后把'recycle'还给内存池，用于网关转发时回收读取到的消息包。
+//
+func (this *TcpConn) sendAndFree(msg, recycle []byte) error {
+	var err = this.send(tcpSendItem{data: msg, recycle: recycle})
+
+	if err != nil {
+		this.Free(recycle)
+	}
+
+	return err
+}
+
+//
+// 把'head'和'body'连在一起作为一个消息包发送，写出以后'head'会被还给内存池，'body'不回收，可以同时发给多个连接。
+//
+func (this *TcpConn) sendHeadAndBody(head, body []byte) error {
+	var err = this.send(tcpSendItem{head: head, data: body, recycle: head})
+
+	if err != nil {
+		this.Free(head)
+	}
+
+	return err
+}
+
+//
+// 把消息包放入发送队列，由连接的发送协程负责实际的写入，所以多个协程可以同时往一个连接发送消息包而不会互相穿插。
+//
+func (this *TcpConn) send(item tcpSendItem) error {
+	select {
+	case <-this.closeChan:
+		return ErrConnClosed
+	default:
+	}
+
+	switch this.sendPolicy {
+	case TcpSendDropNewest:
+		select {
+		case this.sendChan <- item:
+			return nil
+		case <-this.closeChan:
+			return ErrConnClosed
+		default:
+			return ErrSendQueueFull
+		}
+	case TcpSendCloseSlow:
+		select {
+		case this.sendChan <- item:
+			return nil
+		case <-this.closeChan:
+			return ErrConnClosed
+		default:
+			this.setErr(ErrSlowConsumer)
+			this.abort()
+			return ErrSlowConsumer
+		}
+	}
+
+	select {
+	case this.sendChan <- item:
+		return nil
+	case <-this.closeChan:
+		return ErrConnClosed
+	}
+}
+
+//
+// 发送协程，每次尽可能多的取出队列中的消息包，用writev一次性写入，减少系统调用。
+// 连接关闭时会先把队列中剩余的消息包写完再退出。
+//
+func (this *TcpConn) sendLoop() {
+	defer close(this.sendDone)
+
+	var (
+		batch = make([]tcpSendItem, 0, _SEND_BATCH_SIZE_)
+		buffs = make(net.Buffers, 0, 2*_SEND_BATCH_SIZE_) // 每个消息包最多两段
+	)
+
+	for {
+		select {
+		case item := <-this.sendChan:
+			batch = this.fillBatch(append(batch[:0], item))
+
+			if !this.writeBatch(batch, buffs) {
+				return
+			}
+		case <-this.closeChan:
+			for {
+				if batch = this.fillBatch(batch[:0]); len(batch) == 0 {
+					return
+				}
+
+				if !this.writeBatch(batch, buffs) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this *TcpConn) fillBatch(batch []tcpSendItem) []tcpSendItem {
+	for len(batch) < cap(batch) {
+		select {
+		case item := <-this.sendChan:
+			batch = append(batch, item)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+func (this *TcpConn) writeBatch(batch []tcpSendItem, buffs net.Buffers) bool {
+	buffs = buffs[:0]
+
+	for i := range batch {
+		if batch[i].head != nil {
+			buffs = append(buffs, batch[i].head)
+		}
+		buffs = append(buffs, batch[i].data)
+	}
+
+	select {
+	case <-this.closeChan:
+		if flushTime := this.flushTime.Load(); flushTime != 0 {
+			this.conn.SetWriteDeadline(time.Unix(0, flushTime))
+		}
+	default:
+		if this.writeTimeout > 0 {
+			this.conn.SetWriteDeadline(time.Now().Add(this.writeTimeout))
+		}
+	}
+
+	var _, err = buffs.WriteTo(this.conn)
+
+	for i := range batch {
+		this.Free(batch[i].recycle)
+		batch[i] = tcpSendItem{}
+	}
+
+	if err != nil {
+		if isTimeout(err) {
+			this.setErr(ErrWriteTimeout)
+		} else {
+			this.setErr(err)
+		}
+
+		this.abort()
+		return false
+	}
+
+	return true
+}
+
+//
+// 不等待发送队列写完，直接断开连接。
+//
+func (this *TcpConn) abort() {
+	this.closeOnce.Do(func() {
+		close(this.closeChan)
+	})
+
+	this.conn.Close()
+}
@@ -1,9 +1,19 @@
 package tcputil
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var memPool, _ = NewSimpleMemPool(1024, 1024)
@@ -197,7 +207,7 @@ func TestGateway(t *testing.T) {
 		closeWait <- 1
 	}()
 
-	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{1, "127.0.0.1:10010", false}})
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}})
 
 	if err2 != nil {
 		t.Fatal(err2)
@@ -286,7 +296,7 @@ func TestTakeClientAddr(t *testing.T) {
 		closeWait <- 1
 	}()
 
-	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{1, "127.0.0.1:10010", true}})
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010", TakeClientAddr: true}})
 
 	if err2 != nil {
 		t.Fatal(err2)
@@ -310,3 +320,2745 @@ func TestTakeClientAddr(t *testing.T) {
 
 	wg.Wait()
 }
+
+//
+// 测试字节序设置，按字节比较线上格式，不依赖运行测试的CPU的大小端格式
+//
+func TestByteOrder(t *testing.T) {
+	var buff = make([]byte, 2+4+8)
+	var output = &TcpOutput{buff: buff, Data: buff, order: binary.BigEndian}
+
+	output.WriteUint16(0x0102).WriteInt32(-2).WriteUint64(0x0102030405060708)
+
+	if !bytes.Equal(buff, []byte{1, 2, 0xFF, 0xFF, 0xFF, 0xFE, 1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatal("big endian output not match")
+	}
+
+	var input = NewTcpInputWithOrder(buff, binary.BigEndian)
+
+	if input.ReadUint16() != 0x0102 || input.ReadInt32() != -2 || input.ReadUint64() != 0x0102030405060708 {
+		t.Fatal("big endian input not match")
+	}
+
+	if NewTcpInput([]byte{1, 2, 3, 4}).ReadUint32() != 0x04030201 {
+		t.Fatal("default byte order is not little endian")
+	}
+
+	var wg sync.WaitGroup
+
+	var server, err1 = Listen("0.0.0.0:10086", 2, 0, memPool, WithByteOrder(binary.BigEndian))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer func() {
+			server.Close()
+			wg.Done()
+		}()
+
+		var client = server.Accpet()
+
+		if client == nil {
+			t.Error("could't accept")
+			return
+		}
+
+		defer func() {
+			client.Close()
+		}()
+
+		if client.ReadPackage().ReadUint32() != 0x01020304 {
+			t.Error("read message1 failed")
+		}
+
+		if client.NewPackage(2).WriteUint16(0x0A0B).Send() != nil {
+			t.Error("send message2 failed")
+		}
+	}()
+
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		client.Close()
+	}()
+
+	if _, err := client.Write([]byte{0, 4, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	var message2 = make([]byte, 4)
+
+	if _, err := io.ReadFull(client, message2); err != nil || !bytes.Equal(message2, []byte{0, 2, 0x0A, 0x0B}) {
+		t.Fatal("read message2 failed")
+	}
+
+	wg.Wait()
+}
+
+//
+// 测试读取消息包和接受连接时返回的错误信息
+//
+func TestReadPacketError(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	var cases = []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{}, ErrConnClosed},
+		{[]byte{0xFF, 0xFF, 0, 0}, ErrPacketTooLarge},
+		{[]byte{10, 0, 0, 0, 1, 2, 3}, ErrShortRead},
+		{[]byte{10, 0}, ErrShortRead},
+	}
+
+	for i, c := range cases {
+		var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+
+		if _, err := client.Write(c.data); err != nil {
+			t.Fatal(err)
+		}
+
+		client.Close()
+
+		var conn, err3 = server.Accept()
+
+		if err3 != nil {
+			t.Fatal(err3)
+		}
+
+		if _, err := conn.ReadPacket(); err != c.err {
+			t.Fatalf("case %d: expect %v, got %v", i, c.err, err)
+		}
+
+		conn.Close()
+	}
+
+	server.Close()
+
+	if _, err := server.Accept(); err != ErrListenerClosed {
+		t.Fatalf("expect %v, got %v", ErrListenerClosed, err)
+	}
+}
+
+//
+// 测试多个协程同时往一个连接发送消息包
+//
+func TestConcurrentSend(t *testing.T) {
+	const senders, count = 8, 500
+
+	var sendPool, _ = NewSyncMemPool(1024)
+
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer func() {
+		server.Close()
+	}()
+
+	var client, err2 = Connect("127.0.0.1:10086", 4, 0, sendPool, WithSendQueue(16, TcpSendBlock))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	var conn, err3 = server.Accept()
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		conn.Close()
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(sender uint32) {
+			defer wg.Done()
+
+			for seq := uint32(0); seq < count; seq++ {
+				if client.NewPackage(8).WriteUint32(sender).WriteUint32(seq).Send() != nil {
+					t.Error("send failed")
+					return
+				}
+			}
+		}(uint32(i))
+	}
+
+	var next = make([]uint32, senders)
+
+	for i := 0; i < senders*count; i++ {
+		var msg, err = conn.ReadInput()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(msg.Data) != 8 {
+			t.Fatal("package length not match")
+		}
+
+		var sender, seq = msg.ReadUint32(), msg.ReadUint32()
+
+		if sender >= senders || next[sender] != seq {
+			t.Fatal("package interleaved or out of order")
+		}
+
+		next[sender]++
+	}
+
+	wg.Wait()
+
+	client.Close()
+
+	if _, err := conn.ReadPacket(); err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+}
+
+//
+// 测试基于sync.Pool的内存池
+//
+func TestSyncMemPool(t *testing.T) {
+	var pool, err = NewSyncMemPool(1000)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Alloc(1001) != nil {
+		t.Fatal("alloc over max pack size")
+	}
+
+	for _, size := range []int{0, 1, 64, 65, 1000} {
+		var buff = pool.Alloc(size)
+
+		if len(buff) != size || cap(buff) < size || cap(buff)&(cap(buff)-1) != 0 {
+			t.Fatalf("alloc %d got len %d cap %d", size, len(buff), cap(buff))
+		}
+
+		pool.Free(buff)
+	}
+
+	// 不属于任何级别的内存直接忽略
+	pool.Free(make([]byte, 100))
+	pool.Free(make([]byte, 4096))
+}
+
+//
+// 测试大量客户端同时通过网关通讯，需要配合-race参数检查内存池和发送队列的协程安全
+//
+func TestGatewayConcurrent(t *testing.T) {
+	const clients, count = 20, 200
+
+	var pool, _ = NewSyncMemPool(1024)
+
+	var (
+		backend      *TcpGatewayBackend
+		backendReady = make(chan struct{})
+		err1         error
+	)
+
+	backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, pool, func(msg *TcpGatewayIntput) {
+		<-backendReady
+
+		if msg == nil || len(msg.Data) == 0 {
+			return
+		}
+
+		backend.NewPackage(msg.ClientId, len(msg.Data)).WriteBytes(msg.Data).Send()
+	})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	close(backendReady)
+
+	defer func() {
+		backend.Close()
+	}()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, pool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+
+			var client, err = ConnectGateway("127.0.0.1:10086", 4, 0, pool, 1)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer func() {
+				client.Close()
+			}()
+
+			for seq := uint32(0); seq < count; seq++ {
+				if client.NewPackage(8).WriteUint32(id).WriteUint32(seq).Send() != nil {
+					t.Error("send failed")
+					return
+				}
+
+				var buff, err = client.ReadPacket()
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				var msg = NewTcpInput(buff)
+
+				if msg.ReadUint32() != id || msg.ReadUint32() != seq {
+					t.Error("echo not match")
+					return
+				}
+
+				client.Free(buff)
+			}
+		}(uint32(i))
+	}
+
+	wg.Wait()
+}
+
+//
+// 测试读取超时、空闲超时和网关握手超时
+//
+func TestTimeout(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool, WithIdleTimeout(50*time.Millisecond), WithReadTimeout(time.Second))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	var client1, err2 = Connect("127.0.0.1:10086", 4, 0, memPool)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	var conn1, _ = server.Accept()
+
+	if _, err := conn1.ReadPacket(); err != ErrIdleTimeout || conn1.Err() != ErrIdleTimeout {
+		t.Fatalf("expect %v, got %v", ErrIdleTimeout, err)
+	}
+
+	if _, err := client1.ReadPacket(); err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+
+	client1.Close()
+	server.Close()
+
+	server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool, WithReadTimeout(50*time.Millisecond))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	var client2, err3 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	// 只发送消息头，不发送消息内容
+	client2.Write([]byte{4, 0, 0, 0})
+
+	var conn2, _ = server.Accept()
+
+	if _, err := conn2.ReadPacket(); err != ErrReadTimeout || conn2.Err() != ErrReadTimeout {
+		t.Fatalf("expect %v, got %v", ErrReadTimeout, err)
+	}
+
+	client2.Close()
+	server.Close()
+
+	var frontend, err4 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, nil, WithHandshakeTimeout(50*time.Millisecond))
+
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var client3, err5 = Connect("127.0.0.1:10086", 4, 0, memPool, WithIdleTimeout(time.Second))
+
+	if err5 != nil {
+		t.Fatal(err5)
+	}
+
+	defer func() {
+		client3.Close()
+	}()
+
+	if _, err := client3.ReadPacket(); err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+}
+
+//
+// 测试读取超时从消息包的第一个字节到达时算起，不影响比它长的空闲超时
+//
+func TestIdleAndReadTimeout(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool, WithIdleTimeout(time.Second), WithReadTimeout(100*time.Millisecond))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	var conn, _ = server.Accept()
+
+	defer conn.Close()
+
+	// 空闲时间超过读取超时，但没有超过空闲超时
+	time.AfterFunc(300*time.Millisecond, func() {
+		client.Write([]byte{2, 0, 0, 0, 'h', 'i'})
+	})
+
+	if data, err := conn.ReadPacket(); err != nil || string(data) != "hi" {
+		t.Fatalf("expect hi, got %q, %v", data, err)
+	}
+
+	// 消息包开始到达以后仍然受读取超时限制
+	client.Write([]byte{2, 0, 0, 0})
+
+	if _, err := conn.ReadPacket(); err != ErrReadTimeout {
+		t.Fatalf("expect %v, got %v", ErrReadTimeout, err)
+	}
+}
+
+//
+// 测试网关握手，客户端可以选择连接不同的后端
+//
+func TestGatewayHandshake(t *testing.T) {
+	var msgChan = make(chan *TcpGatewayIntput, 1)
+
+	var backend1, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer func() {
+		backend1.Close()
+	}()
+
+	var backend2, err2 = NewTcpGatewayBackend("0.0.0.0:10011", 4, memPool, func(msg *TcpGatewayIntput) {
+		if msg != nil && len(msg.Data) != 0 {
+			msgChan <- msg
+		}
+	})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		backend2.Close()
+	}()
+
+	var frontend, err3 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{
+		{Id: 1, Addr: "127.0.0.1:10010"},
+		{Id: 2, Addr: "127.0.0.1:10011"},
+		{Id: 3, Addr: "127.0.0.1:10012"},
+	})
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var client, err4 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 2)
+
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+
+	defer func() {
+		client.Close()
+	}()
+
+	if client.NewPackage(4).WriteUint32(1234).Send() != nil {
+		t.Fatal("send message1 failed")
+	}
+
+	if (<-msgChan).ReadUint32() != 1234 {
+		t.Fatal("read message1 failed")
+	}
+
+	if _, err := ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 3); err != ErrGatewayBackendUnavailable {
+		t.Fatalf("expect %v, got %v", ErrGatewayBackendUnavailable, err)
+	}
+
+	if _, err := ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 4); err != ErrGatewayUnknownBackend {
+		t.Fatalf("expect %v, got %v", ErrGatewayUnknownBackend, err)
+	}
+}
+
+//
+// 测试网关心跳，后端失去响应时网关前端应该断开连接并报告原因
+//
+func TestGatewayHeartbeat(t *testing.T) {
+	var events = make(chan *TcpGatewayLinkEvent, 10)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {}, WithHeartbeat(20*time.Millisecond, 3))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		WithHeartbeat(20*time.Millisecond, 3),
+		WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) {
+			events <- event
+		}),
+	)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	if event := <-events; !event.Up || event.Id != 1 {
+		t.Fatal("link up event not match")
+	}
+
+	// 双方都在正常收发心跳，连接不应该断开
+	select {
+	case <-events:
+		t.Fatal("link should keep alive")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	frontend.Close()
+	backend.Close()
+
+	<-events
+
+	// 模拟一个只完成握手，之后就失去响应的后端
+	var server, err3 = Listen("0.0.0.0:10010", 4, 0, memPool)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		server.Close()
+	}()
+
+	var silentConn = make(chan *TcpConn, 1)
+
+	go func() {
+		var conn = server.Accpet()
+
+		if conn != nil {
+			conn.NewPackage(4 + 1).WriteUint32(0).WriteUint8(_GATEWAY_LINK_BITS_).Send()
+		}
+
+		silentConn <- conn
+	}()
+
+	defer func() {
+		if conn := <-silentConn; conn != nil {
+			conn.Close()
+		}
+	}()
+
+	frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		WithHeartbeat(20*time.Millisecond, 3),
+		WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) {
+			events <- event
+		}),
+	)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	if event := <-events; !event.Up {
+		t.Fatal("link up event not match")
+	}
+
+	select {
+	case event := <-events:
+		if event.Up || event.Error != ErrHeartbeatTimeout {
+			t.Fatalf("expect %v, got %v", ErrHeartbeatTimeout, event.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat timeout not detected")
+	}
+}
+
+//
+// 测试网关前端自动重连后端
+//
+func TestGatewayReconnect(t *testing.T) {
+	var events = make(chan *TcpGatewayLinkEvent, 10)
+
+	// 后端还没启动，首次连接会失败，之后在后台重连
+	var frontend, err1 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		WithReconnect(20*time.Millisecond, 100*time.Millisecond),
+		WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) {
+			events <- event
+		}),
+	)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var ignore = func(msg *TcpGatewayIntput) {}
+
+	for i := 0; i < 2; i++ {
+		var backend, err2 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, ignore)
+
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+
+		select {
+		case event := <-events:
+			if !event.Up || event.Id != 1 {
+				t.Fatal("link up event not match")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("reconnect timeout")
+		}
+
+		var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+		if err3 != nil {
+			t.Fatal(err3)
+		}
+
+		client.Close()
+		backend.Close()
+
+		if event := <-events; event.Up {
+			t.Fatal("link down event not match")
+		}
+	}
+}
+
+//
+// 测试网关后端优雅关闭，现有客户端不受影响，新客户端不再分配过来
+//
+func TestGatewayShutdown(t *testing.T) {
+	var (
+		backend      *TcpGatewayBackend
+		backendReady = make(chan struct{})
+		backendDone  = make(chan struct{})
+		err1         error
+	)
+
+	backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {
+		<-backendReady
+
+		if msg == nil {
+			close(backendDone)
+			return
+		}
+
+		if len(msg.Data) != 0 {
+			backend.NewPackage(msg.ClientId, 4).WriteUint32(msg.ReadUint32()).Send()
+		}
+	})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	close(backendReady)
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}}, WithReconnect(0, 0))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	var shutdownResult = make(chan error, 1)
+
+	go func() {
+		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		shutdownResult <- backend.Shutdown(ctx)
+	}()
+
+	// 排空通知到达以后，新的客户端不再分配到这个后端
+	for i := 0; ; i++ {
+		var newClient, err = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+		if err == ErrGatewayBackendUnavailable {
+			break
+		}
+
+		if err != nil || i == 100 {
+			t.Fatalf("expect %v, got %v", ErrGatewayBackendUnavailable, err)
+		}
+
+		newClient.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 现有的客户端还可以正常通讯
+	if client.NewPackage(4).WriteUint32(1234).Send() != nil {
+		t.Fatal("send message1 failed")
+	}
+
+	if msg := client.ReadPackage(); msg == nil || msg.ReadUint32() != 1234 {
+		t.Fatal("read message1 failed")
+	}
+
+	select {
+	case <-shutdownResult:
+		t.Fatal("shutdown should wait for existing client")
+	default:
+	}
+
+	client.Close()
+
+	if err := <-shutdownResult; err != nil {
+		t.Fatal(err)
+	}
+
+	<-backendDone
+
+	if backend.Err() != ErrGatewayShutdown {
+		t.Fatalf("expect %v, got %v", ErrGatewayShutdown, backend.Err())
+	}
+
+	if err := frontend.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var server, err1 = ListenContext(context.Background(), "0.0.0.0:10086", 4, 0, memPool, WithReusePort(true))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var ctx1, cancel1 = context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel1()
+
+	if _, err := server.AcceptContext(ctx1); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// 超时以后监听器仍然可以正常使用
+	var client, err2 = DialContext(context.Background(), "127.0.0.1:10086", 4, 0, memPool, WithLocalAddr("127.0.0.1:0"))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	var conn, err3 = server.AcceptContext(context.Background())
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer conn.Close()
+
+	var ctx2, cancel2 = context.WithCancel(context.Background())
+
+	cancel2()
+
+	if _, err := DialContext(ctx2, "127.0.0.1:10086", 4, 0, memPool); err == nil {
+		t.Fatal("expect error when dialing with canceled context")
+	}
+}
+
+func TestFramer(t *testing.T) {
+	var pool, _ = NewSyncMemPool(8192)
+
+	var (
+		headFramer, _      = NewTcpHeadFramer(2, binary.BigEndian)
+		delimiterFramer, _ = NewTcpDelimiterFramer([]byte("\r\n"), 6000)
+		fixedFramer, _     = NewTcpFixedFramer(5)
+		lengthFramer, _    = NewTcpLengthFieldFramer(TcpLengthField{
+			LengthFieldOffset:   2,
+			LengthFieldLength:   2,
+			LengthAdjustment:    -4,
+			InitialBytesToStrip: 4,
+			Prefix:              []byte{0xCA, 0xFE},
+			Order:               binary.BigEndian,
+		})
+	)
+
+	var cases = []struct {
+		framer TcpFramer
+		msgs   []string
+		wire   []byte
+	}{
+		{headFramer, []string{"hello", "", strings.Repeat("a", 300)}, []byte{0, 5, 'h', 'e', 'l', 'l', 'o'}},
+		{NewTcpVarintFramer(), []string{"hello", "", strings.Repeat("b", 300)}, []byte{5, 'h', 'e', 'l', 'l', 'o'}},
+		{delimiterFramer, []string{"hello", "", strings.Repeat("c", 5000)}, []byte{'h', 'e', 'l', 'l', 'o', '\r', '\n'}},
+		{fixedFramer, []string{"hello", "world"}, []byte{'h', 'e', 'l', 'l', 'o'}},
+		{lengthFramer, []string{"hello", "", strings.Repeat("d", 300)}, []byte{0xCA, 0xFE, 0, 9, 'h', 'e', 'l', 'l', 'o'}},
+	}
+
+	for i, c := range cases {
+		var server, err1 = Listen("0.0.0.0:10086", 4, 0, pool, WithFramer(c.framer))
+
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+
+		var client, err2 = Connect("127.0.0.1:10086", 4, 0, pool, WithFramer(c.framer))
+
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+
+		var conn, err3 = server.Accept()
+
+		if err3 != nil {
+			t.Fatal(err3)
+		}
+
+		for _, msg := range c.msgs {
+			if client.NewPackage(len(msg)).WriteBytes([]byte(msg)).Send() != nil {
+				t.Fatalf("case %d: send failed", i)
+			}
+		}
+
+		for _, msg := range c.msgs {
+			if data, err := conn.ReadPacket(); err != nil || string(data) != msg {
+				t.Fatalf("case %d: expect %d bytes, got %d bytes, %v", i, len(msg), len(data), err)
+			}
+		}
+
+		// 检查实际写出的数据
+		var frame = conn.NewPackage(5)
+
+		frame.WriteBytes([]byte("hello"))
+
+		if !bytes.Equal(frame.buff, c.wire) {
+			t.Fatalf("case %d: expect %v, got %v", i, c.wire, frame.buff)
+		}
+
+		if c.framer == fixedFramer && client.NewPackage(4) != nil {
+			t.Fatalf("case %d: expect nil package for mismatched frame size", i)
+		}
+
+		client.Close()
+		conn.Close()
+		server.Close()
+	}
+
+	var smallFramer, _ = NewTcpDelimiterFramer([]byte("\n"), 8)
+
+	var server, err4 = Listen("0.0.0.0:10086", 4, 0, pool, WithFramer(smallFramer))
+
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+
+	defer server.Close()
+
+	var client, err5 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err5 != nil {
+		t.Fatal(err5)
+	}
+
+	defer client.Close()
+
+	client.Write([]byte("0123456789\n"))
+
+	var conn, _ = server.Accept()
+
+	defer conn.Close()
+
+	if _, err := conn.ReadPacket(); err != ErrPacketTooLarge {
+		t.Fatalf("expect %v, got %v", ErrPacketTooLarge, err)
+	}
+}
+
+func TestGatewayFramer(t *testing.T) {
+	var framer, _ = NewTcpDelimiterFramer([]byte("\n"), 512)
+
+	var backendReady = make(chan *TcpGatewayBackend, 1)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {
+		if msg == nil || len(msg.Data) == 0 {
+			return
+		}
+
+		var backend = <-backendReady
+
+		backendReady <- backend
+
+		var reply = strings.ToUpper(string(msg.Data))
+
+		backend.NewPackage(msg.ClientId, len(reply)).WriteBytes([]byte(reply)).Send()
+	}, WithFramer(framer))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	backendReady <- backend
+
+	defer func() {
+		backend.Close()
+	}()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{
+		{Id: 1, Addr: "127.0.0.1:10010"},
+	}, WithFramer(framer))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1, WithFramer(framer))
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		client.Close()
+	}()
+
+	if client.NewPackage(5).WriteBytes([]byte("hello")).Send() != nil {
+		t.Fatal("send failed")
+	}
+
+	if data, err := client.ReadPacket(); err != nil || string(data) != "HELLO" {
+		t.Fatalf("expect HELLO, got %q, %v", data, err)
+	}
+}
+
+func TestLengthFieldFramer(t *testing.T) {
+	var framer, _ = NewTcpLengthFieldFramer(TcpLengthField{
+		LengthFieldOffset: 2,
+		LengthFieldLength: 2,
+		LengthAdjustment:  -4,
+		Order:             binary.BigEndian,
+	})
+
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool, WithFramer(framer))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	// 第二个包的长度信息比头部还短
+	client.Write([]byte{0xCA, 0xFE, 0, 6, 'h', 'i', 0xCA, 0xFE, 0, 3})
+
+	var conn, _ = server.Accept()
+
+	defer conn.Close()
+
+	// 没有去掉头部，消息内容包含完整的帧
+	if data, err := conn.ReadPacket(); err != nil || !bytes.Equal(data, []byte{0xCA, 0xFE, 0, 6, 'h', 'i'}) {
+		t.Fatalf("unexpected frame %v, %v", data, err)
+	}
+
+	if _, err := conn.ReadPacket(); err != ErrFrameSize {
+		t.Fatalf("expect %v, got %v", ErrFrameSize, err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	var pool, _ = NewSyncMemPool(1024)
+	var delimiterFramer, _ = NewTcpDelimiterFramer([]byte("\n"), 1000)
+
+	for i, framer := range []TcpFramer{nil, NewTcpVarintFramer(), delimiterFramer} {
+		var opts []TcpOption
+
+		if framer != nil {
+			opts = append(opts, WithFramer(framer))
+		}
+
+		var server, err1 = Listen("0.0.0.0:10086", 2, 0, pool, opts...)
+
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+
+		var client, err2 = Connect("127.0.0.1:10086", 2, 0, pool, opts...)
+
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+
+		var conn, _ = server.Accept()
+
+		// 预计长度远小于实际长度，需要多次扩容，varint头部也会变长
+		var builder = client.NewBuilder(4)
+
+		for j := 0; j < 100; j++ {
+			builder.WriteUint8('a').WriteUint16(0x6262)
+		}
+
+		if err := builder.Send(); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+
+		// 预计长度准确，不需要扩容
+		if err := client.NewBuilder(5).WriteBytes([]byte("hello")).Send(); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+
+		if data, err := conn.ReadPacket(); err != nil || string(data) != strings.Repeat("abb", 100) {
+			t.Fatalf("case %d: unexpected packet %q, %v", i, data, err)
+		}
+
+		if data, err := conn.ReadPacket(); err != nil || string(data) != "hello" {
+			t.Fatalf("case %d: unexpected packet %q, %v", i, data, err)
+		}
+
+		// 超过内存池允许的长度
+		if err := client.NewBuilder(0).WriteBytes(make([]byte, 2000)).WriteUint32(1).Send(); err != ErrPacketTooLarge {
+			t.Fatalf("case %d: expect %v, got %v", i, ErrPacketTooLarge, err)
+		}
+
+		client.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestSafeInput(t *testing.T) {
+	var input = NewTcpInput([]byte{1, 2, 0, 3, 4, 5, 6}).Safe()
+
+	if input.ReadUint8() != 1 || input.Err() != nil {
+		t.Fatal("read uint8 failed")
+	}
+
+	// 长度前缀是2，读出两个字节以后只剩两个字节，再读uint32就超出了
+	if data := input.ReadBytes16(); !bytes.Equal(data, []byte{3, 4}) || input.Err() != nil {
+		t.Fatalf("read bytes16 failed: %v, %v", data, input.Err())
+	}
+
+	if input.ReadUint32() != 0 || input.Err() != ErrInputTooShort {
+		t.Fatalf("expect %v, got %v", ErrInputTooShort, input.Err())
+	}
+
+	// 错误是粘滞的，剩余的数据也不能再读
+	if input.ReadUint8() != 0 || input.Err() != ErrInputTooShort || len(input.Data) != 0 {
+		t.Fatal("sticky error not work")
+	}
+
+	input = NewTcpInput([]byte{0xFF, 1, 2}).Safe()
+
+	if data := input.ReadBytes8(); data != nil || input.Err() != ErrInputTooShort {
+		t.Fatalf("expect %v, got %v", ErrInputTooShort, input.Err())
+	}
+
+	// 默认模式仍然panic
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect panic")
+		}
+	}()
+
+	NewTcpInput(nil).ReadInt8()
+}
+
+func TestPackageHelpers(t *testing.T) {
+	var size = 1 + 3 + 3 + 4 + 8 + UvarintSize(300) + VarintSize(-3) + 1
+
+	var buff = make([]byte, size)
+	var output = &TcpOutput{buff: buff, Data: buff, order: binary.BigEndian}
+
+	output.WriteBool(true).WriteString16("a").WriteString8("bc").WriteFloat32(1.5).WriteFloat64(-2.25).WriteUvarint(300).WriteVarint(-3).WriteBool(false)
+
+	if len(output.Data) != 0 {
+		t.Fatalf("expect %d bytes, %d bytes left", size, len(output.Data))
+	}
+
+	if !bytes.Equal(buff[:4], []byte{1, 0, 1, 'a'}) || !bytes.Equal(buff[7:11], []byte{0x3F, 0xC0, 0, 0}) {
+		t.Fatalf("unexpected output %v", buff)
+	}
+
+	var input = NewTcpInputWithOrder(buff, binary.BigEndian).Safe()
+
+	if !input.PeekBool() || !input.ReadBool() {
+		t.Fatal("read bool failed")
+	}
+
+	if input.PeekString16() != "a" || input.ReadString16() != "a" || input.ReadString8() != "bc" {
+		t.Fatal("read string failed")
+	}
+
+	if input.ReadFloat32() != 1.5 || input.PeekFloat64() != -2.25 || input.ReadFloat64() != -2.25 {
+		t.Fatal("read float failed")
+	}
+
+	if input.PeekUvarint() != 300 || input.ReadUvarint() != 300 || input.ReadVarint() != -3 || input.ReadBool() {
+		t.Fatal("read varint failed")
+	}
+
+	if input.Err() != nil || len(input.Data) != 0 {
+		t.Fatalf("unexpected state %v, %v", input.Err(), input.Data)
+	}
+
+	// 不完整的varint
+	if input = NewTcpInput([]byte{0x80, 0x80}).Safe(); input.PeekUvarint() != 0 || input.Err() != ErrInputTooShort {
+		t.Fatalf("expect %v, got %v", ErrInputTooShort, input.Err())
+	}
+}
+
+type routerEcho struct {
+	Text string
+}
+
+func (this *routerEcho) Size() int {
+	return 1 + len(this.Text)
+}
+
+func (this *routerEcho) MarshalTo(out *TcpOutput) *TcpOutput {
+	return out.WriteString8(this.Text)
+}
+
+func (this *routerEcho) UnmarshalFrom(in *TcpInput) error {
+	this.Text = in.ReadString8()
+	return in.Err()
+}
+
+func newTestRouter(count *int32) *TcpRouter {
+	var router = NewTcpRouter()
+
+	router.Use(TcpRecover(), func(next TcpHandler) TcpHandler {
+		return func(req *TcpRequest) error {
+			atomic.AddInt32(count, 1)
+			return next(req)
+		}
+	})
+
+	router.HandleMessage(1, func() TcpUnmarshaler { return new(routerEcho) }, func(req *TcpRequest, msg TcpUnmarshaler) error {
+		return req.Reply(2, &routerEcho{strings.ToUpper(msg.(*routerEcho).Text)})
+	})
+
+	router.Handle(3, func(req *TcpRequest) error {
+		panic("boom")
+	})
+
+	return router
+}
+
+//
+// 测试按消息ID分派
+//
+func TestRouter(t *testing.T) {
+	var count int32
+
+	var router = newTestRouter(&count)
+
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var serveErr = make(chan error, 1)
+
+	go func() {
+		var conn = server.Accpet()
+
+		if conn == nil {
+			serveErr <- ErrConnClosed
+			return
+		}
+
+		defer conn.Close()
+
+		serveErr <- router.Serve(conn)
+	}()
+
+	var client, err2 = Connect("127.0.0.1:10086", 4, 0, memPool)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	client.NewPackage(2 + 1 + 5).WriteUint16(1).WriteString8("hello").Send()
+
+	var reply = client.ReadPackage()
+
+	if reply.ReadUint16() != 2 || reply.ReadString8() != "HELLO" {
+		t.Fatal("echo failed")
+	}
+
+	// 没有注册的消息ID
+	client.NewPackage(2).WriteUint16(100).Send()
+
+	if reply = client.ReadPackage(); reply.ReadUint16() != TcpUnknownMessageId || reply.ReadUint16() != 100 {
+		t.Fatal("unknown reply failed")
+	}
+
+	// 中间件对未知消息同样生效
+	if n := atomic.LoadInt32(&count); n != 2 {
+		t.Fatalf("expect 2 calls, got %d", n)
+	}
+
+	// 处理函数panic被转换成错误，Serve返回
+	client.NewPackage(2).WriteUint16(3).Send()
+
+	if err := <-serveErr; err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expect panic error, got %v", err)
+	}
+}
+
+//
+// 测试在网关后端使用路由
+//
+func TestGatewayRouter(t *testing.T) {
+	var count int32
+
+	var router = newTestRouter(&count)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, router.GatewayHandler())
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer func() {
+		backend.Close()
+	}()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{
+		{Id: 1, Addr: "127.0.0.1:10010", TakeClientAddr: true},
+	})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		client.Close()
+	}()
+
+	client.NewPackage(2 + 1 + 2).WriteUint16(1).WriteString8("hi").Send()
+
+	var reply = client.ReadPackage()
+
+	if reply.ReadUint16() != 2 || reply.ReadString8() != "HI" {
+		t.Fatal("echo failed")
+	}
+
+	// 客户端地址消息不会被当作普通消息分派
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Fatalf("expect 1 dispatch, got %d", n)
+	}
+
+	// 消息内容不完整时解码失败，客户端被移除
+	client.NewPackage(2 + 1).WriteUint16(1).WriteUint8(10).Send()
+
+	if _, err := client.ReadPacket(); err == nil {
+		t.Fatal("expect client removed")
+	}
+}
+
+//
+// 测试请求/应答调用
+//
+func TestRpc(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var serverRpc = make(chan *TcpRpc, 1)
+
+	go func() {
+		var conn = server.Accpet()
+
+		if conn == nil {
+			return
+		}
+
+		// 收到"slow"时晚一点再应答，其余的请求倒序延迟应答，验证应答能对上请求
+		serverRpc <- NewTcpRpc(conn, func(req *TcpRpcRequest) {
+			var msg routerEcho
+
+			if msg.UnmarshalFrom(req.Input) != nil {
+				return
+			}
+
+			go func() {
+				if msg.Text == "slow" {
+					time.Sleep(200 * time.Millisecond)
+				} else {
+					time.Sleep(time.Duration(100-len(msg.Text)) * time.Millisecond)
+				}
+
+				req.Reply(&routerEcho{strings.ToUpper(msg.Text)})
+			}()
+		}, nil)
+	}()
+
+	var conn, err2 = Connect("127.0.0.1:10086", 4, 0, memPool)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	var messages = make(chan string, 1)
+
+	var client = NewTcpRpc(conn, nil, func(msg *TcpInput) {
+		if msg != nil {
+			messages <- msg.ReadString8()
+		}
+	})
+
+	defer client.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+
+			var reply, err = client.Call(context.Background(), &routerEcho{text})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if got := reply.ReadString8(); got != strings.ToUpper(text) {
+				t.Errorf("expect %q, got %q", strings.ToUpper(text), got)
+			}
+		}(strings.Repeat("a", i))
+	}
+
+	// 调用进行中普通消息包照常收发
+	var rpc = <-serverRpc
+
+	defer rpc.Close()
+
+	rpc.NewMessage(1 + 4).WriteString8("push").Send()
+
+	if msg := <-messages; msg != "push" {
+		t.Fatalf("expect push, got %q", msg)
+	}
+
+	wg.Wait()
+
+	// 超时的调用返回ctx的错误，迟到的应答被丢掉
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel()
+
+	if _, err := client.Call(ctx, &routerEcho{"slow"}); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if n := client.Pending(); n != 0 {
+		t.Fatalf("expect no pending call, got %d", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if reply, err := client.Call(context.Background(), &routerEcho{"b"}); err != nil || reply.ReadString8() != "B" {
+		t.Fatalf("call after timeout failed: %v", err)
+	}
+
+	// 连接断开时等待中的调用返回错误
+	var done = make(chan error, 1)
+
+	go func() {
+		var _, err = client.Call(context.Background(), &routerEcho{"slow"})
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rpc.Close()
+
+	if err := <-done; err == nil {
+		t.Fatal("expect error after close")
+	}
+
+	if _, err := client.Call(context.Background(), &routerEcho{"b"}); err == nil {
+		t.Fatal("expect error after close")
+	}
+}
+
+type sessionEvent struct {
+	kind    string
+	session *TcpGatewaySession
+	text    string
+	reason  error
+}
+
+type sessionRecorder chan *sessionEvent
+
+func (this sessionRecorder) OnConnect(session *TcpGatewaySession) {
+	session.Attach(session.Addr())
+	this <- &sessionEvent{kind: "connect", session: session}
+}
+
+func (this sessionRecorder) OnMessage(session *TcpGatewaySession, msg *TcpInput) {
+	var text = msg.Safe().ReadString8()
+
+	session.Send([]byte(strings.ToUpper(text)))
+
+	this <- &sessionEvent{kind: "message", session: session, text: text}
+}
+
+func (this sessionRecorder) OnDisconnect(session *TcpGatewaySession, reason error) {
+	this <- &sessionEvent{kind: "disconnect", session: session, reason: reason}
+}
+
+func (this sessionRecorder) expect(t *testing.T, kind string) *sessionEvent {
+	t.Helper()
+
+	select {
+	case event := <-this:
+		if event.kind != kind {
+			t.Fatalf("expect %s, got %s", kind, event.kind)
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("wait %s timeout", kind)
+	}
+
+	return nil
+}
+
+//
+// 测试网关后端的会话接口
+//
+func TestGatewaySession(t *testing.T) {
+	var events = make(sessionRecorder, 16)
+
+	var backend, err1 = NewTcpGatewaySessionBackend("0.0.0.0:10010", 4, memPool, events)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010", TakeClientAddr: true}}, WithGatewayFrontendId(7))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var begin = time.Now()
+
+	// 客户端自己断开
+	var client1, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	var session = events.expect(t, "connect").session
+
+	if !strings.HasPrefix(session.Addr(), "127.0.0.1:") || session.Data() != session.Addr() || session.LinkId() != 0 {
+		t.Fatalf("unexpected session %d, %q, %v", session.Id(), session.Addr(), session.Data())
+	}
+
+	if session.FrontendId() != 7 || session.ConnectTime().Before(begin.Add(-time.Second)) || session.ConnectTime().After(time.Now()) {
+		t.Fatalf("unexpected session info %d, %v", session.FrontendId(), session.ConnectTime())
+	}
+
+	if backend.Session(session.Id()) != session || backend.SessionCount() != 1 {
+		t.Fatal("session lookup failed")
+	}
+
+	client1.NewPackage(1 + 2).WriteString8("hi").Send()
+
+	if event := events.expect(t, "message"); event.session != session || event.text != "hi" {
+		t.Fatalf("unexpected message %q", event.text)
+	}
+
+	if data, err := client1.ReadPacket(); err != nil || string(data) != "HI" {
+		t.Fatalf("expect HI, got %q, %v", data, err)
+	}
+
+	// 空消息包不再被当作断开
+	client1.NewPackage(0).Send()
+
+	if event := events.expect(t, "message"); event.session != session || event.text != "" {
+		t.Fatalf("unexpected message %q", event.text)
+	}
+
+	client1.ReadPacket()
+
+	client1.Close()
+
+	if event := events.expect(t, "disconnect"); event.session != session || event.reason != ErrConnClosed {
+		t.Fatalf("unexpected disconnect %v", event.reason)
+	}
+
+	if backend.Session(session.Id()) != nil || session.Detach() != session.Addr() || session.Data() != nil {
+		t.Fatal("session not removed")
+	}
+
+	// 后端主动断开
+	var client2, err4 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+
+	defer client2.Close()
+
+	events.expect(t, "connect").session.Close()
+
+	if _, err := client2.ReadPacket(); err == nil {
+		t.Fatal("expect client2 closed")
+	}
+
+	events.expect(t, "disconnect")
+
+	// 跟网关前端的连接断开时，上面的会话都断开
+	var client3, err5 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err5 != nil {
+		t.Fatal(err5)
+	}
+
+	defer client3.Close()
+
+	events.expect(t, "connect")
+
+	frontend.Close()
+
+	if event := events.expect(t, "disconnect"); event.reason == nil {
+		t.Fatal("expect disconnect reason")
+	}
+
+	if backend.SessionCount() != 0 {
+		t.Fatal("sessions not cleared")
+	}
+}
+
+//
+// 测试广播包只发给目标客户端所在的网关前端
+//
+func TestBroadcastGroup(t *testing.T) {
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	// 直接连接网关后端冒充两个网关前端，按连接顺序得到序号0和1
+	var links [2]*TcpConn
+
+	for i := range links {
+		var link, err = Connect("127.0.0.1:10010", 4, 0, memPool)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer link.Close()
+
+		// 跟网关前端一样先告诉网关后端内存池的限制
+		link.NewPackage(4).WriteUint32(1024).Send()
+
+		if beginId := link.ReadPackage().ReadUint32(); beginId != uint32(i)<<24 {
+			t.Fatalf("expect link %d, got begin id %x", i, beginId)
+		}
+
+		links[i] = link
+	}
+
+	// 序号5的连接不存在，它的客户端被忽略
+	var ids = []uint32{1<<24 | 1, 0<<24 | 1, 5<<24 | 1, 1<<24 | 2}
+
+	if backend.NewBroadcast(ids, 2).WriteUint16(0xABCD).Send() != nil {
+		t.Fatal("send broadcast failed")
+	}
+
+	var expects = [][]uint32{{0<<24 | 1}, {1<<24 | 1, 1<<24 | 2}}
+
+	for i, link := range links {
+		var msg = link.ReadPackage()
+
+		if msg.ReadUint8() != _GATEWAY_COMMAND_BROADCAST_ {
+			t.Fatal("expect broadcast command")
+		}
+
+		var idNum = int(msg.ReadUint16())
+
+		if idNum != len(expects[i]) {
+			t.Fatalf("link %d: expect %d ids, got %d", i, len(expects[i]), idNum)
+		}
+
+		for _, id := range expects[i] {
+			if got := msg.ReadUint32(); got != id {
+				t.Fatalf("link %d: expect id %x, got %x", i, id, got)
+			}
+		}
+
+		// 发给客户端的完整消息包
+		if msg.ReadUint32() != 2 || msg.ReadUint16() != 0xABCD || len(msg.Data) != 0 {
+			t.Fatalf("link %d: bad broadcast body", i)
+		}
+	}
+
+	// 全部目标都不在线时不创建广播包
+	if backend.NewBroadcast([]uint32{5<<24 | 1}, 2) != nil {
+		t.Fatal("expect nil broadcast")
+	}
+}
+
+//
+// 测试广播命令的拆分以及广播给全部客户端
+//
+func TestBroadcastAll(t *testing.T) {
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	if backend.NewBroadcastAll(2) != nil {
+		t.Fatal("expect nil broadcast without links")
+	}
+
+	var link, err2 = Connect("127.0.0.1:10010", 4, 0, memPool)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer link.Close()
+
+	link.NewPackage(4).WriteUint32(1024).Send()
+	link.ReadPackage()
+
+	// 内存池最多只能分配1024字节，1000个客户端ID需要拆成多个广播命令
+	var ids = make([]uint32, 1000)
+
+	for i := range ids {
+		ids[i] = uint32(i + 1)
+	}
+
+	if backend.NewBroadcast(ids, 2).WriteUint16(0xABCD).Send() != nil {
+		t.Fatal("send broadcast failed")
+	}
+
+	for next := uint32(1); next <= uint32(len(ids)); {
+		var msg = link.ReadPackage()
+
+		if msg == nil || msg.ReadUint8() != _GATEWAY_COMMAND_BROADCAST_ {
+			t.Fatal("expect broadcast command")
+		}
+
+		for idNum := int(msg.ReadUint16()); idNum > 0; idNum-- {
+			if id := msg.ReadUint32(); id != next {
+				t.Fatalf("expect id %d, got %d", next, id)
+			}
+			next++
+		}
+
+		if msg.ReadUint32() != 2 || msg.ReadUint16() != 0xABCD {
+			t.Fatal("bad broadcast body")
+		}
+	}
+
+	if backend.NewBroadcastAll(2).WriteUint16(0x1234).Send() != nil {
+		t.Fatal("send broadcast all failed")
+	}
+
+	if msg := link.ReadPackage(); msg.ReadUint8() != _GATEWAY_COMMAND_BROADCAST_ALL_ || msg.ReadUint32() != 2 || msg.ReadUint16() != 0x1234 {
+		t.Fatal("bad broadcast all")
+	}
+}
+
+//
+// 测试网关前端把广播全部客户端的命令转发给它的所有客户端
+//
+func TestGatewayBroadcastAll(t *testing.T) {
+	var events = make(sessionRecorder, 16)
+
+	var backend, err1 = NewTcpGatewaySessionBackend("0.0.0.0:10010", 4, memPool, events)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var clients [3]*TcpConn
+
+	for i := range clients {
+		var client, err = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+
+		events.expect(t, "connect")
+
+		clients[i] = client
+	}
+
+	if backend.NewBroadcastAll(4).WriteUint32(67890).Send() != nil {
+		t.Fatal("send broadcast all failed")
+	}
+
+	for i, client := range clients {
+		if client.ReadPackage().ReadUint32() != 67890 {
+			t.Fatalf("client %d: read broadcast failed", i)
+		}
+	}
+}
+
+//
+// 测试网关前端维护的分组广播
+//
+func TestGatewayGroup(t *testing.T) {
+	var events = make(sessionRecorder, 16)
+
+	var backend, err1 = NewTcpGatewaySessionBackend("0.0.0.0:10010", 4, memPool, events)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	var (
+		clients  [3]*TcpConn
+		sessions [3]*TcpGatewaySession
+	)
+
+	for i := range clients {
+		var client, err = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+
+		clients[i], sessions[i] = client, events.expect(t, "connect").session
+	}
+
+	sessions[0].JoinGroup(7)
+	sessions[1].JoinGroup(7)
+	sessions[1].JoinGroup(7)
+	sessions[2].JoinGroup(8)
+
+	// 同一个连接上的命令按顺序处理，加入分组的命令一定先于广播到达
+	backend.NewGroupBroadcast(7, 4).WriteUint32(1).Send()
+	backend.NewGroupBroadcast(8, 4).WriteUint32(2).Send()
+
+	for i, expect := range []uint32{1, 1, 2} {
+		if got := clients[i].ReadPackage().ReadUint32(); got != expect {
+			t.Fatalf("client %d: expect %d, got %d", i, expect, got)
+		}
+	}
+
+	// 重复加入不会收到两次
+	sessions[1].LeaveGroup(7)
+
+	backend.NewGroupBroadcast(7, 4).WriteUint32(3).Send()
+	backend.NewPackage(sessions[1].Id(), 4).WriteUint32(4).Send()
+
+	if clients[0].ReadPackage().ReadUint32() != 3 || clients[1].ReadPackage().ReadUint32() != 4 {
+		t.Fatal("leave group failed")
+	}
+
+	// 客户端断开以后自动移出分组，空分组被删除
+	clients[0].Close()
+	clients[2].Close()
+
+	events.expect(t, "disconnect")
+	events.expect(t, "disconnect")
+
+	var link = frontend.getLink(1)
+
+	for i := 0; ; i++ {
+		link.clientsMutex.RLock()
+		var groups, clientGroups = len(link.groups), len(link.clientGroups)
+		link.clientsMutex.RUnlock()
+
+		if groups == 0 && clientGroups == 0 {
+			break
+		}
+
+		if i == 100 {
+			t.Fatalf("expect no groups, got %d, %d", groups, clientGroups)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// 测试客户端ID的分配、回收和用完检测
+//
+func TestClientIdAlloc(t *testing.T) {
+	var link = &tcpGatewayLink{
+		clients:       make(map[uint32]*TcpConn),
+		groups:        make(map[uint32]map[uint32]*TcpConn),
+		clientGroups:  make(map[uint32][]uint32),
+		beginClientId: 5 << 2,
+		maxLocalId:    3,
+	}
+
+	var client = &TcpConn{}
+
+	for i := uint32(1); i <= 3; i++ {
+		if id := link.AddClient(client); id != 5<<2|i {
+			t.Fatalf("expect %d, got %d", 5<<2|i, id)
+		}
+	}
+
+	if id := link.AddClient(client); id != 0 {
+		t.Fatalf("expect 0 after client ids used up, got %d", id)
+	}
+
+	// 只有断开的客户端ID会被重用
+	link.DelClient(5<<2 | 2)
+
+	if id := link.AddClient(client); id != 5<<2|2 {
+		t.Fatalf("expect %d, got %d", 5<<2|2, id)
+	}
+
+	// 从上一次分配的位置之后开始找
+	link.DelClient(5<<2 | 1)
+	link.DelClient(5<<2 | 3)
+
+	if id := link.AddClient(client); id != 5<<2|3 {
+		t.Fatalf("expect %d, got %d", 5<<2|3, id)
+	}
+}
+
+//
+// 测试网关前端从后端获取连接序号位数
+//
+func TestGatewayLinkBits(t *testing.T) {
+	var events = make(sessionRecorder, 16)
+
+	var backend, err1 = NewTcpGatewaySessionBackend("0.0.0.0:10010", 4, memPool, events, WithGatewayLinkBits(12))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}})
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	if link := frontend.getLink(1); link == nil || link.maxLocalId != 1<<20-1 {
+		t.Fatal("link bits not negotiated")
+	}
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer client.Close()
+
+	var session = events.expect(t, "connect").session
+
+	if session.Id() != 1 || session.LinkId() != 0 {
+		t.Fatalf("unexpected client id %x", session.Id())
+	}
+
+	session.Send([]byte("ok"))
+
+	if data, err := client.ReadPacket(); err != nil || string(data) != "ok" {
+		t.Fatalf("expect ok, got %q, %v", data, err)
+	}
+}
+
+//
+// 测试后端分组的选择策略
+//
+func TestGatewayBalancer(t *testing.T) {
+	var backends = []*TcpGatewayBackendState{
+		{&TcpGatewayBackendInfo{Id: 1, Weight: 1}, 3},
+		{&TcpGatewayBackendInfo{Id: 2}, 1},
+		{&TcpGatewayBackendInfo{Id: 3, Weight: 8}, 1},
+	}
+
+	var roundRobin = NewTcpRoundRobinBalancer()
+
+	for i := 0; i < 6; i++ {
+		if selected := roundRobin.Select(nil, backends); selected != i%3 {
+			t.Fatalf("round robin: expect %d, got %d", i%3, selected)
+		}
+	}
+
+	if selected := NewTcpLeastClientsBalancer().Select(nil, backends); selected != 1 {
+		t.Fatalf("least clients: expect 1, got %d", selected)
+	}
+
+	var (
+		weighted = NewTcpWeightedBalancer()
+		counts   [3]int
+	)
+
+	for i := 0; i < 1000; i++ {
+		counts[weighted.Select(nil, backends)]++
+	}
+
+	if counts[0] == 0 || counts[1] == 0 || counts[2] <= counts[0]+counts[1] {
+		t.Fatalf("weighted: unexpected counts %v", counts)
+	}
+
+	// 去掉一个后端时，原来没有选到它的键不受影响
+	var hash = NewTcpHashBalancer()
+
+	for i := 0; i < 100; i++ {
+		var (
+			key      = []byte(strconv.Itoa(i))
+			selected = hash.Select(key, backends)
+		)
+
+		if hash.Select(key, backends) != selected {
+			t.Fatalf("hash: key %d not stable", i)
+		}
+
+		if selected != 0 && backends[1:][hash.Select(key, backends[1:])] != backends[selected] {
+			t.Fatalf("hash: key %d moved", i)
+		}
+	}
+}
+
+//
+// 测试按后端分组接入，以及后端断开以后客户端转移到分组中的其它后端
+//
+func TestGatewayBackendGroup(t *testing.T) {
+	var (
+		events1 = make(sessionRecorder, 16)
+		events2 = make(sessionRecorder, 16)
+	)
+
+	var backend1, err1 = NewTcpGatewaySessionBackend("0.0.0.0:10010", 4, memPool, events1)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend1.Close()
+
+	var backend2, err2 = NewTcpGatewaySessionBackend("0.0.0.0:10011", 4, memPool, events2)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer backend2.Close()
+
+	var frontend, err3 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{
+		{Id: 1, Addr: "127.0.0.1:10010", Group: 100},
+		{Id: 2, Addr: "127.0.0.1:10011", Group: 100},
+	}, WithGatewayBalancer(100, NewTcpHashBalancer()), WithReconnect(0, 0))
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	// 同一个键总是选到同一个后端
+	var clients [2]*TcpConn
+
+	for i := range clients {
+		var client, err = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 100, WithGatewayKey([]byte("user1")))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+
+		clients[i] = client
+	}
+
+	var (
+		current, other         = backend1, backend2
+		currentEvents, standby = events1, events2
+	)
+
+	select {
+	case <-events2:
+		current, other = backend2, backend1
+		currentEvents, standby = events2, events1
+	case <-events1:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait connect timeout")
+	}
+
+	currentEvents.expect(t, "connect")
+
+	if current.SessionCount() != 2 || other.SessionCount() != 0 {
+		t.Fatalf("expect same backend, got %d, %d", current.SessionCount(), other.SessionCount())
+	}
+
+	if _, err := ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 200); err != ErrGatewayUnknownBackend {
+		t.Fatalf("expect %v, got %v", ErrGatewayUnknownBackend, err)
+	}
+
+	// 后端断开以后客户端不断开，转移到分组中的另一个后端
+	current.Close()
+
+	standby.expect(t, "connect")
+	standby.expect(t, "connect")
+
+	for _, client := range clients {
+		client.NewPackage(1 + 2).WriteString8("hi").Send()
+
+		if data, err := client.ReadPacket(); err != nil || string(data) != "HI" {
+			t.Fatalf("expect HI, got %q, %v", data, err)
+		}
+
+		standby.expect(t, "message")
+	}
+
+	// 分组中没有可用的后端时断开客户端
+	other.Close()
+
+	for _, client := range clients {
+		if _, err := client.ReadPacket(); err == nil {
+			t.Fatal("expect client closed")
+		}
+	}
+
+	if _, err := ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 100); err != ErrGatewayBackendUnavailable {
+		t.Fatalf("expect %v, got %v", ErrGatewayBackendUnavailable, err)
+	}
+}
+
+//
+// 测试客户端的分帧方式跟网关之间的头部不匹配的情况
+//
+func TestGatewayFrameLimit(t *testing.T) {
+	var fixedFramer, _ = NewTcpFixedFramer(8)
+
+	if _, err := NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, nil, WithFramer(fixedFramer)); err == nil {
+		t.Fatal("expect framer rejected")
+	}
+
+	var msgChan = make(chan []byte, 10)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 1, memPool, func(msg *TcpGatewayIntput) {
+		if msg != nil && len(msg.Data) != 0 {
+			msgChan <- append([]byte(nil), msg.Data...)
+		}
+	})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 1, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}}, WithFramer(NewTcpVarintFramer()))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	// 1字节的头部写不下300字节的消息包，客户端应该被断开
+	var client1, err3 = ConnectGateway("127.0.0.1:10086", 1, 0, memPool, 1, WithFramer(NewTcpVarintFramer()))
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer client1.Close()
+
+	client1.NewPackage(300).WriteBytes(bytes.Repeat([]byte{'x'}, 300)).Send()
+
+	if _, err := client1.ReadPacket(); err == nil {
+		t.Fatal("expect client closed")
+	}
+
+	// 同一个连接上的其它客户端不受影响
+	var client2, err4 = ConnectGateway("127.0.0.1:10086", 1, 0, memPool, 1, WithFramer(NewTcpVarintFramer()))
+
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+
+	defer client2.Close()
+
+	client2.NewPackage(2).WriteBytes([]byte("hi")).Send()
+
+	select {
+	case data := <-msgChan:
+		if string(data) != "hi" {
+			t.Fatalf("expect hi, got %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait message timeout")
+	}
+}
+
+//
+// 测试对方不接收数据时'Close'也会马上返回，正在读取的调用马上结束
+//
+func TestCloseNonBlocking(t *testing.T) {
+	var pool, _ = NewSyncMemPool(1 << 20)
+
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, pool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	// 只连接，从不读取
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	var conn, _ = server.Accept()
+
+	// 写满两端的socket缓冲区，发送协程会阻塞在写入上
+	for i := 0; i < 64; i++ {
+		conn.NewPackage(1<<20 - 4).Send()
+	}
+
+	var readErr = make(chan error, 1)
+
+	go func() {
+		var _, err = conn.ReadPacket()
+		readErr <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	var begin = time.Now()
+
+	conn.Close()
+
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Fatalf("close blocked for %v", elapsed)
+	}
+
+	select {
+	case err := <-readErr:
+		if err != ErrConnClosed {
+			t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("read not interrupted")
+	}
+}
+
+type countingPool struct {
+	MemPool
+	frees int32
+}
+
+func (this *countingPool) Free(buff []byte) {
+	atomic.AddInt32(&this.frees, 1)
+}
+
+//
+// 测试调用取消时已经送到的应答会被还给内存池
+//
+func TestRpcCancelFree(t *testing.T) {
+	var pool = &countingPool{MemPool: memPool}
+
+	var rpc = &TcpRpc{
+		conn:    &TcpConn{memPool: pool},
+		pending: make(map[uint32]chan []byte),
+	}
+
+	// 读取协程已经取走了应答并放进通道，调用方同时因为ctx结束而放弃等待
+	var reply = make(chan []byte, 1)
+
+	reply <- pool.Alloc(1 + 4)
+
+	rpc.cancel(1, reply)
+
+	if n := atomic.LoadInt32(&pool.frees); n != 1 {
+		t.Fatalf("expect reply freed, got %d frees", n)
+	}
+
+	// 还没有应答时什么都不做
+	rpc.cancel(2, make(chan []byte, 1))
+
+	if n := atomic.LoadInt32(&pool.frees); n != 1 {
+		t.Fatalf("expect 1 free, got %d", n)
+	}
+}
+
+//
+// 测试客户端的超时设置不会作用于网关之间的连接，连接空闲时不会被断开
+//
+func TestGatewayLinkIgnoresClientTimeouts(t *testing.T) {
+	var timeouts = []TcpOption{WithIdleTimeout(100 * time.Millisecond), WithReadTimeout(50 * time.Millisecond), WithWriteTimeout(50 * time.Millisecond)}
+
+	var msgChan = make(chan string, 1)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {
+		if msg != nil && len(msg.Data) != 0 {
+			msgChan <- string(msg.Data)
+		}
+	}, timeouts...)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var events = make(chan *TcpGatewayLinkEvent, 10)
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		append(timeouts, WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) { events <- event }))...)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	<-events
+
+	// 连接空闲的时间超过客户端的空闲超时
+	time.Sleep(300 * time.Millisecond)
+
+	select {
+	case event := <-events:
+		t.Fatalf("link closed: %v", event.Error)
+	default:
+	}
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer client.Close()
+
+	client.NewPackage(2).WriteBytes([]byte("hi")).Send()
+
+	select {
+	case text := <-msgChan:
+		if text != "hi" {
+			t.Fatalf("expect hi, got %q", text)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait message timeout")
+	}
+}
+
+//
+// 测试广播命令按网关前端内存池的限制拆分，不会因为网关前端申请不到内存而断开连接
+//
+func TestGatewayBroadcastLimit(t *testing.T) {
+	var clientIdChan = make(chan uint32, 1)
+
+	var backend, err1 = NewTcpGatewayBackend("0.0.0.0:10010", 4, memPool, func(msg *TcpGatewayIntput) {
+		if msg != nil && len(msg.Data) != 0 {
+			clientIdChan <- msg.ClientId
+		}
+	})
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer backend.Close()
+
+	var events = make(chan *TcpGatewayLinkEvent, 10)
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) { events <- event }))
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	<-events
+
+	var client, err3 = ConnectGateway("127.0.0.1:10086", 4, 0, memPool, 1)
+
+	if err3 != nil {
+		t.Fatal(err3)
+	}
+
+	defer client.Close()
+
+	client.NewPackage(2).WriteBytes([]byte("hi")).Send()
+
+	var clientId = <-clientIdChan
+
+	// 200个客户端ID加上600字节的消息超过了网关前端1024字节的内存池限制，真实的客户端放在最后一个广播命令里
+	var ids = make([]uint32, 200)
+
+	for i := range ids {
+		ids[i] = clientId + uint32(len(ids)-i)
+	}
+
+	ids[len(ids)-1] = clientId
+
+	if err := backend.NewBroadcast(ids, 600).WriteBytes(bytes.Repeat([]byte{'x'}, 600)).Send(); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := client.ReadPackage(); msg == nil || len(msg.Data) != 600 {
+		t.Fatal("read broadcast failed")
+	}
+
+	// 连一个客户端ID都放不下的广播不会发送
+	if err := backend.NewBroadcast([]uint32{clientId}, 1020).WriteBytes(bytes.Repeat([]byte{'x'}, 1020)).Send(); err != ErrPacketTooLarge {
+		t.Fatalf("expect %v, got %v", ErrPacketTooLarge, err)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("link closed: %v", event.Error)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.NewPackage(2).WriteBytes([]byte("hi")).Send()
+
+	select {
+	case <-clientIdChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait message timeout")
+	}
+}
+
+//
+// 测试发送队列满了以后的处理策略，对方只连接从不读取
+//
+func TestSendPolicy(t *testing.T) {
+	var pool, _ = NewSyncMemPool(1 << 20)
+
+	for _, policy := range []TcpSendPolicy{TcpSendDropNewest, TcpSendCloseSlow} {
+		var server, err1 = Listen("0.0.0.0:10086", 4, 0, pool, WithSendQueue(1, policy))
+
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+
+		var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+
+		var conn, _ = server.Accept()
+
+		// 写满socket缓冲区以后发送协程阻塞在写入上，队列很快就满了
+		var err error
+
+		for i := 0; i < 64 && err == nil; i++ {
+			err = conn.NewPackage(1<<20 - 4).Send()
+		}
+
+		switch policy {
+		case TcpSendDropNewest:
+			if err != ErrSendQueueFull {
+				t.Fatalf("expect %v, got %v", ErrSendQueueFull, err)
+			}
+			if conn.Err() != nil {
+				t.Fatalf("expect conn alive, got %v", conn.Err())
+			}
+		case TcpSendCloseSlow:
+			if err != ErrSlowConsumer {
+				t.Fatalf("expect %v, got %v", ErrSlowConsumer, err)
+			}
+			if conn.Err() != ErrSlowConsumer {
+				t.Fatalf("expect %v, got %v", ErrSlowConsumer, conn.Err())
+			}
+			if err := conn.NewPackage(4).Send(); err != ErrConnClosed {
+				t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+			}
+		}
+
+		conn.Close()
+		client.Close()
+		server.Close()
+	}
+}
+
+//
+// 测试对方断开以后，没有调用'Close'的连接也会结束发送协程
+//
+func TestPeerClosed(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	var conn, _ = server.Accept()
+
+	client.Close()
+
+	if _, err := conn.ReadPacket(); err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+
+	select {
+	case <-conn.sendDone:
+	case <-time.After(time.Second):
+		t.Fatal("send loop not exited")
+	}
+
+	if err := conn.NewPackage(4).Send(); err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+}
+
+//
+// 测试网关之间的消息包只发了一半就停下时，心跳超时同样会断开连接
+//
+func TestGatewayHeartbeatStall(t *testing.T) {
+	var server, err1 = Listen("0.0.0.0:10010", 4, 0, memPool)
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	var stallConn = make(chan *TcpConn, 1)
+
+	// 模拟一个完成握手后只发出消息包第一个字节的后端
+	go func() {
+		var conn = server.Accpet()
+
+		if conn != nil {
+			conn.NewPackage(4 + 1).WriteUint32(0).WriteUint8(_GATEWAY_LINK_BITS_).Send()
+			conn.sendRaw([]byte{0})
+		}
+
+		stallConn <- conn
+	}()
+
+	defer func() {
+		if conn := <-stallConn; conn != nil {
+			conn.Close()
+		}
+	}()
+
+	var events = make(chan *TcpGatewayLinkEvent, 10)
+
+	var frontend, err2 = NewTcpGatewayFrontend("0.0.0.0:10086", 4, memPool, []*TcpGatewayBackendInfo{{Id: 1, Addr: "127.0.0.1:10010"}},
+		WithHeartbeat(20*time.Millisecond, 3),
+		WithGatewayLinkEvent(func(event *TcpGatewayLinkEvent) {
+			events <- event
+		}),
+	)
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer func() {
+		frontend.Close()
+	}()
+
+	if event := <-events; !event.Up {
+		t.Fatal("link up event not match")
+	}
+
+	select {
+	case event := <-events:
+		if event.Up || event.Error != ErrHeartbeatTimeout {
+			t.Fatalf("expect %v, got %v", ErrHeartbeatTimeout, event.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat timeout not detected")
+	}
+}
+
+//
+// 测试网关前端不回复握手结果时，取消'ctx'可以马上结束等待
+//
+func TestConnectGatewayCancel(t *testing.T) {
+	var listener, err1 = net.Listen("tcp", "127.0.0.1:10086")
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer listener.Close()
+
+	var accepted = make(chan net.Conn, 1)
+
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	// 取消的时机跟开始等待握手结果的时机越接近，越容易出现取消被超时设置覆盖的情况，所以多试几次
+	for i := 0; i < 20; i++ {
+		var ctx, cancel = context.WithCancel(context.Background())
+
+		go func(delay time.Duration) {
+			var conn = <-accepted
+
+			defer conn.Close()
+
+			// 收到握手请求以后客户端就开始等待握手结果了
+			io.ReadFull(conn, make([]byte, 4+4))
+
+			time.Sleep(delay)
+			cancel()
+		}(time.Duration(i) * 100 * time.Microsecond)
+
+		var begin = time.Now()
+
+		if _, err := ConnectGatewayContext(ctx, "127.0.0.1:10086", 4, 0, memPool, 1); err != context.Canceled {
+			t.Fatalf("expect %v, got %v", context.Canceled, err)
+		}
+
+		if elapsed := time.Since(begin); elapsed > time.Second {
+			t.Fatalf("cancel took %v", elapsed)
+		}
+
+		cancel()
+	}
+}
+
+//
+// 测试对方不接收数据时，写出超时会断开连接
+//
+func TestWriteTimeout(t *testing.T) {
+	var pool, _ = NewSyncMemPool(1 << 20)
+
+	var server, err1 = Listen("0.0.0.0:10086", 4, 0, pool, WithWriteTimeout(100*time.Millisecond))
+
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	defer server.Close()
+
+	// 只连接，从不读取
+	var client, err2 = net.Dial("tcp", "127.0.0.1:10086")
+
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	defer client.Close()
+
+	var conn, _ = server.Accept()
+
+	defer conn.Close()
+
+	var begin = time.Now()
+
+	// 写满socket缓冲区以后发送协程阻塞在写入上，超时断开以后'Send'返回ErrConnClosed
+	var err error
+
+	for i := 0; i < 256 && err == nil; i++ {
+		err = conn.NewPackage(1<<20 - 4).Send()
+	}
+
+	if err != ErrConnClosed {
+		t.Fatalf("expect %v, got %v", ErrConnClosed, err)
+	}
+
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("write timeout took %v", elapsed)
+	}
+
+	if conn.Err() != ErrWriteTimeout {
+		t.Fatalf("expect %v, got %v", ErrWriteTimeout, conn.Err())
+	}
+}
+
+//
+// 测试Accept错误的分类，文件句柄耗尽等错误需要等待重试
+//
+func TestIsTemporary(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ECONNABORTED} {
+		if err := (&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", errno)}); !isTemporary(err) {
+			t.Fatalf("expect %v temporary", err)
+		}
+	}
+
+	if isTemporary(&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EINVAL)}) {
+		t.Fatal("expect EINVAL not temporary")
+	}
+}
@@ -1,22 +1,51 @@
 package tcputil
 
 import (
+	"encoding/binary"
 	"errors"
-	"reflect"
-	"unsafe"
+	"math/bits"
+	"sync"
 )
 
 //
-// 内存池需要实现的接口
+// 内存池需要实现的接口，实现必须是协程安全的，因为同一个内存池通常会被很多连接同时使用。
 //
 type MemPool interface {
 	Alloc(size int) []byte
 }
 
+//
+// 可以回收内存的内存池需要额外实现的接口，这是可选的。
+// 'TcpConn'和网关在确定一块内存不再被使用时会调用'Free'把它还给内存池，调用之后就不能再访问这块内存。
+//
+type RecyclableMemPool interface {
+	MemPool
+	Free(buff []byte)
+}
+
+//
+// 限制了申请长度的内存池需要额外实现的接口，这是可选的。
+// 网关前端会把'MaxPackSize'告诉网关后端，网关后端据此拆分广播命令，避免网关前端读取时申请不到内存。
+//
+type LimitedMemPool interface {
+	MemPool
+	MaxPackSize() int
+}
+
+// 内存池允许申请的最大长度，没有实现'LimitedMemPool'时返回0，表示不知道
+func memPoolMaxSize(memPool MemPool) int {
+	if pool, ok := memPool.(LimitedMemPool); ok {
+		return pool.MaxPackSize()
+	}
+
+	return 0
+}
+
 //
 // 简单的内存池实现，用于避免频繁的零散内存申请
 //
 type SimpleMemPool struct {
+	mutex       sync.Mutex
 	memPool     []byte
 	memPoolSize int
 	maxPackSize int
@@ -46,60 +75,125 @@ func (this *SimpleMemPool) Alloc(size int) (result []byte) {
 		return nil
 	}
 
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if len(this.memPool) < size {
 		this.memPool = make([]byte, this.memPoolSize)
 	}
 
-	result = this.memPool[0:size]
+	result = this.memPool[0:size:size]
 	this.memPool = this.memPool[size:]
 
 	return result
 }
 
-func getUint(buff []byte, pack int) int {
-	var ptr = unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&buff)).Data)
+//
+// 返回允许申请的最大长度
+//
+func (this *SimpleMemPool) MaxPackSize() int {
+	return this.maxPackSize
+}
 
+const (
+	_SYNC_POOL_MIN_BITS_ = 6 // 最小的一级是64字节
+)
+
+//
+// 基于sync.Pool的内存池实现，按2的幂次把内存块分成多个级别，每个级别一个sync.Pool。
+// 跟'SimpleMemPool'不同，这个内存池支持回收内存，适合消息包大小差异很大，或者消息包处理完可以及时释放的场景。
+//
+type SyncMemPool struct {
+	pools       []sync.Pool
+	maxPackSize int
+}
+
+//
+// 创建一个基于sync.Pool的内存池，参数'maxPackSize'用于限制外部申请内存允许的最大长度。
+//
+func NewSyncMemPool(maxPackSize int) (*SyncMemPool, error) {
+	if maxPackSize <= 0 {
+		return nil, errors.New("maxPackSize <= 0")
+	}
+
+	return &SyncMemPool{
+		pools:       make([]sync.Pool, syncPoolClass(maxPackSize)+1),
+		maxPackSize: maxPackSize,
+	}, nil
+}
+
+func syncPoolClass(size int) int {
+	if size <= 1<<_SYNC_POOL_MIN_BITS_ {
+		return 0
+	}
+
+	return bits.Len(uint(size-1)) - _SYNC_POOL_MIN_BITS_
+}
+
+//
+// 申请一块内存，如果'size'超过'maxPackSize'设置将返回nil
+//
+func (this *SyncMemPool) Alloc(size int) []byte {
+	if size > this.maxPackSize {
+		return nil
+	}
+
+	var class = syncPoolClass(size)
+
+	if buff, ok := this.pools[class].Get().(*[]byte); ok {
+		return (*buff)[:size]
+	}
+
+	return make([]byte, size, 1<<(class+_SYNC_POOL_MIN_BITS_))
+}
+
+//
+// 返回允许申请的最大长度
+//
+func (this *SyncMemPool) MaxPackSize() int {
+	return this.maxPackSize
+}
+
+//
+// 回收一块由'Alloc'申请的内存，容量不符合内存池级别的内存会被忽略。
+//
+func (this *SyncMemPool) Free(buff []byte) {
+	var size = cap(buff)
+
+	if size < 1<<_SYNC_POOL_MIN_BITS_ || size&(size-1) != 0 {
+		return
+	}
+
+	if class := syncPoolClass(size); class < len(this.pools) {
+		buff = buff[:size]
+		this.pools[class].Put(&buff)
+	}
+}
+
+func getUint(buff []byte, pack int, order binary.ByteOrder) int {
 	switch pack {
 	case 1:
 		return int(buff[0])
 	case 2:
-		return int(*(*uint16)(ptr))
+		return int(order.Uint16(buff))
 	case 4:
-		return int(*(*uint32)(ptr))
+		return int(order.Uint32(buff))
 	case 8:
-		return int(*(*uint64)(ptr))
+		return int(order.Uint64(buff))
 	}
 
 	return 0
 }
 
-func setUint(buff []byte, pack, value int) {
-	var ptr = unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&buff)).Data)
-
+func setUint(buff []byte, pack, value int, order binary.ByteOrder) {
 	switch pack {
 	case 1:
 		buff[0] = byte(value)
 	case 2:
-		*(*uint16)(ptr) = uint16(value)
+		order.PutUint16(buff, uint16(value))
 	case 4:
-		*(*uint32)(ptr) = uint32(value)
+		order.PutUint32(buff, uint32(value))
 	case 8:
-		*(*uint64)(ptr) = uint64(value)
+		order.PutUint64(buff, uint64(value))
 	}
 }
-
-func getUint16(target []byte) uint16 {
-	return *(*uint16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&target)).Data))
-}
-
-func setUint16(target []byte, value uint16) {
-	*(*uint16)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&target)).Data)) = value
-}
-
-func getUint32(target []byte) uint32 {
-	return *(*uint32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&target)).Data))
-}
-
-func setUint32(target []byte, value uint32) {
-	*(*uint32)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&target)).Data)) = value
-}
@@ -1,9 +1,20 @@
 package tcputil
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_ACCEPT_MIN_DELAY_ = 5 * time.Millisecond
+	_ACCEPT_MAX_DELAY_ = time.Second
 )
 
 //
@@ -13,24 +24,31 @@ type TcpListener struct {
 	pack     int
 	padding  int
 	memPool  MemPool
+	config   tcpConfig
 	listener *net.TCPListener
 }
 
 //
 // 基于现有的监听器包装一个面向包协议的监听器。
-// 参数'pack'用于设置消息包的头部长度，消息包长度就存放在其中，所以请根据消息包的最大长度可能性设置此参数，'pack'必须是1, 2, 4或者8。
+// 参数'pack'用于设置消息包的头部长度，消息包长度就存放在其中，所以请根据消息包的最大长度可能性设置此参数，'pack'必须是1, 2, 4或者8，通过'WithFramer'设置了其他分帧方式时这个参数不起作用。
 // 参数'padding'通常只要设置成0，这个参数用于优化网关通讯，避免不必要的内存分配和数据复制，请参考'Read'方法。
 // 参数'memPool'用于指派一个内存池实现，用于优化通讯协议解析时的内存分配，请参考'SimpleMemPool'类型。
+// 参数'opts'用于设置字节序等可选参数，请参考'TcpOption'类型，Accept得到的连接会使用同样的设置。
 //
-func NewTcpListener(listener *net.TCPListener, pack, padding int, memPool MemPool) (*TcpListener, error) {
-	if pack != 1 && pack != 2 && pack != 4 && pack != 8 {
-		return nil, errors.New("pack != 1 && pack != 2 && pack != 4 && pack != 8")
+func NewTcpListener(listener *net.TCPListener, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpListener, error) {
+	return newTcpListener(listener, pack, padding, memPool, newTcpConfig(opts))
+}
+
+func newTcpListener(listener *net.TCPListener, pack, padding int, memPool MemPool, config tcpConfig) (*TcpListener, error) {
+	if _, err := config.newFramer(pack); err != nil {
+		return nil, err
 	}
 
 	return &TcpListener{
 		pack:     pack,
 		padding:  padding,
 		memPool:  memPool,
+		config:   config,
 		listener: listener,
 	}, nil
 }
@@ -38,7 +56,18 @@ func NewTcpListener(listener *net.TCPListener, pack, padding int, memPool MemPoo
 //
 // 监听指定地址和端口并返回一个基于消息包的监听器，参数说明参考‘NewTcpListener'。
 //
-func Listen(addr string, pack, padding int, memPool MemPool) (*TcpListener, error) {
+func Listen(addr string, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpListener, error) {
+	return ListenContext(context.Background(), addr, pack, padding, memPool, opts...)
+}
+
+//
+// 跟'Listen'一样，区别是可以通过'ctx'取消监听操作，并且会应用'WithKeepAlive'、'WithReusePort'等选项。
+//
+func ListenContext(ctx context.Context, addr string, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpListener, error) {
+	return listenTcp(ctx, addr, newTcpConfig(opts), pack, padding, memPool)
+}
+
+func listenTcp(ctx context.Context, addr string, config tcpConfig, pack, padding int, memPool MemPool) (*TcpListener, error) {
 	if memPool == nil {
 		return nil, errors.New("memPool == nil")
 	}
@@ -48,11 +77,18 @@ func Listen(addr string, pack, padding int, memPool MemPool) (*TcpListener, erro
 		listener net.Listener
 	)
 
-	if listener, err = net.Listen("tcp", addr); err != nil {
+	if listener, err = config.listenConfig().Listen(ctx, "tcp", addr); err != nil {
 		return nil, err
 	}
 
-	return NewTcpListener(listener.(*net.TCPListener), pack, padding, memPool)
+	var tcpListener, err2 = newTcpListener(listener.(*net.TCPListener), pack, padding, memPool, config)
+
+	if err2 != nil {
+		listener.Close()
+		return nil, err2
+	}
+
+	return tcpListener, nil
 }
 
 //
@@ -64,152 +100,510 @@ func (this *TcpListener) Close() error {
 
 //
 // 等待一个新进连接，调用会一直阻塞，直到新的连接进入或者监听器关闭。
+// 出错时返回nil，需要知道具体原因请使用'Accept'。
 //
 func (this *TcpListener) Accpet() *TcpConn {
+	var conn, _ = this.Accept()
+
+	return conn
+}
+
+//
+// 等待一个新进连接，跟'Accpet'的区别是会返回具体的错误信息。
+// 监听器关闭时返回ErrListenerClosed，其他错误原样返回，可能只是暂时性的错误，例如文件句柄耗尽。
+//
+func (this *TcpListener) Accept() (*TcpConn, error) {
+	return this.AcceptContext(context.Background())
+}
+
+//
+// 等待一个新进连接，跟'Accept'的区别是'ctx'结束时会停止等待并返回ctx.Err()。
+// 这个方法借助监听器的超时设置实现，所以不要在多个协程中同时调用。
+//
+func (this *TcpListener) AcceptContext(ctx context.Context) (*TcpConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var stop = context.AfterFunc(ctx, func() {
+		this.listener.SetDeadline(time.Unix(1, 0))
+	})
+
 	var conn, err1 = this.listener.AcceptTCP()
 
+	if !stop() {
+		this.listener.SetDeadline(time.Time{})
+
+		if err1 != nil {
+			return nil, ctx.Err()
+		}
+	}
+
 	if err1 != nil {
-		return nil
+		if errors.Is(err1, net.ErrClosed) {
+			return nil, ErrListenerClosed
+		}
+		return nil, err1
 	}
 
-	var tcpConn, err2 = NewTcpConn(conn, this.pack, this.padding, this.memPool)
+	var tcpConn, err2 = newTcpConn(conn, this.pack, this.padding, this.memPool, this.config)
 
 	if err2 != nil {
-		return nil
+		conn.Close()
+		return nil, err2
 	}
 
-	return tcpConn
+	return tcpConn, nil
+}
+
+//
+// 循环接受新进连接并交给'handler'处理，直到监听器关闭。
+// 遇到暂时性的错误时等待一段时间再重试，等待时间逐次加倍，避免文件句柄耗尽之类的错误让循环空转或者退出。
+//
+func (this *TcpListener) acceptLoop(handler func(conn *TcpConn)) {
+	var delay time.Duration
+
+	for {
+		var conn, err = this.Accept()
+
+		if err == nil {
+			delay = 0
+			handler(conn)
+			continue
+		}
+
+		if err == ErrListenerClosed {
+			return
+		}
+
+		if !isTemporary(err) {
+			delay = _ACCEPT_MAX_DELAY_
+		} else if delay == 0 {
+			delay = _ACCEPT_MIN_DELAY_
+		} else if delay *= 2; delay > _ACCEPT_MAX_DELAY_ {
+			delay = _ACCEPT_MAX_DELAY_
+		}
+
+		time.Sleep(delay)
+	}
 }
 
 //
 // 面向包协议的网络连接。
 //
 type TcpConn struct {
-	conn    *net.TCPConn
-	pack    int
-	padding int
-	head    []byte
-	memPool MemPool
+	conn       *net.TCPConn
+	pack       int
+	padding    int
+	framer     TcpFramer
+	reader     *bufio.Reader
+	memPool    MemPool
+	order      binary.ByteOrder
+	sendChan   chan tcpSendItem
+	sendPolicy TcpSendPolicy
+	sendDone   chan struct{}
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	closeWait  sync.Once
+	closeErr   error
+	errMutex   sync.Mutex
+	flushTime  atomic.Int64
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	hasDeadline  bool
+	safeInput    bool
 }
 
 //
 // 从现有网络连接包装一个面向包协议的网络连接，参数说明参考‘NewTcpListener'。
 //
-func NewTcpConn(conn *net.TCPConn, pack, padding int, memPool MemPool) (*TcpConn, error) {
-	if pack != 1 && pack != 2 && pack != 4 && pack != 8 {
-		return nil, errors.New("pack != 1 && pack != 2 && pack != 4 && pack != 8")
+func NewTcpConn(conn *net.TCPConn, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpConn, error) {
+	return newTcpConn(conn, pack, padding, memPool, newTcpConfig(opts))
+}
+
+func newTcpConn(conn *net.TCPConn, pack, padding int, memPool MemPool, config tcpConfig) (*TcpConn, error) {
+	var framer, err = config.newFramer(pack)
+
+	if err != nil {
+		return nil, err
 	}
 
 	if memPool == nil {
 		return nil, errors.New("memPool == nil")
 	}
 
-	return &TcpConn{
-		conn:    conn,
-		pack:    pack,
-		padding: padding,
-		head:    make([]byte, pack),
-		memPool: memPool,
-	}, nil
+	var this = &TcpConn{
+		conn:       conn,
+		pack:       pack,
+		padding:    padding,
+		framer:     framer,
+		reader:     bufio.NewReaderSize(conn, _READ_BUFFER_SIZE_),
+		memPool:    memPool,
+		order:      config.order,
+		sendChan:   make(chan tcpSendItem, config.sendQueueSize),
+		sendPolicy: config.sendPolicy,
+		sendDone:   make(chan struct{}),
+		closeChan:  make(chan struct{}),
+
+		readTimeout:  config.readTimeout,
+		writeTimeout: config.writeTimeout,
+		idleTimeout:  config.idleTimeout,
+		safeInput:    config.safeInput,
+	}
+
+	go this.sendLoop()
+
+	return this, nil
 }
 
 //
 // 连接目标地址，并返回一个面向包协议的连接，参数说明参考'NewTcpListener'。
 //
-func Connect(addr string, pack, padding int, memPool MemPool) (*TcpConn, error) {
-	var conn, err2 = net.Dial("tcp", addr)
+func Connect(addr string, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpConn, error) {
+	return DialContext(context.Background(), addr, pack, padding, memPool, opts...)
+}
+
+//
+// 跟'Connect'一样，区别是可以通过'ctx'取消连接操作，并且会应用'WithDialTimeout'、'WithKeepAlive'、'WithLocalAddr'等选项。
+//
+func DialContext(ctx context.Context, addr string, pack, padding int, memPool MemPool, opts ...TcpOption) (*TcpConn, error) {
+	return dialTcp(ctx, addr, newTcpConfig(opts), pack, padding, memPool)
+}
+
+func dialTcp(ctx context.Context, addr string, config tcpConfig, pack, padding int, memPool MemPool) (*TcpConn, error) {
+	var dialer, err1 = config.dialer()
+
+	if err1 != nil {
+		return nil, err1
+	}
+
+	var conn, err2 = dialer.DialContext(ctx, "tcp", addr)
 
 	if err2 != nil {
 		return nil, err2
 	}
 
-	return NewTcpConn(conn.(*net.TCPConn), pack, padding, memPool)
+	var tcpConn, err3 = newTcpConn(conn.(*net.TCPConn), pack, padding, memPool, config)
+
+	if err3 != nil {
+		conn.Close()
+		return nil, err3
+	}
+
+	return tcpConn, nil
 }
 
 //
-// 连接网关，参考'Connect'。
+// 连接网关，参数'backendId'是要连接的后端ID或者后端分组ID，其他参数参考'Connect'。
+// 连接建立后会等待网关前端回复握手结果，后端ID不存在时返回ErrGatewayUnknownBackend，后端暂时不可用时返回ErrGatewayBackendUnavailable。
 //
-func ConnectGateway(addr string, pack, padding int, memPool MemPool, backendId uint32) (*TcpConn, error) {
-	var conn, err1 = net.Dial("tcp", addr)
+func ConnectGateway(addr string, pack, padding int, memPool MemPool, backendId uint32, opts ...TcpOption) (*TcpConn, error) {
+	return ConnectGatewayContext(context.Background(), addr, pack, padding, memPool, backendId, opts...)
+}
 
-	if err1 != nil {
-		return nil, err1
-	}
+//
+// 跟'ConnectGateway'一样，区别是'ctx'可以同时取消连接操作和等待握手结果。
+//
+func ConnectGatewayContext(ctx context.Context, addr string, pack, padding int, memPool MemPool, backendId uint32, opts ...TcpOption) (*TcpConn, error) {
+	var config = newTcpConfig(opts)
 
-	var tcpConn, err2 = NewTcpConn(conn.(*net.TCPConn), pack, padding, memPool)
+	var tcpConn, err2 = dialTcp(ctx, addr, config, pack, padding, memPool)
 
 	if err2 != nil {
 		return nil, err2
 	}
 
-	if err3 := tcpConn.NewPackage(4).WriteUint32(1).Send(); err3 != nil {
+	var handshake = tcpConn.NewPackage(4 + len(config.gatewayKey))
+
+	if handshake == nil {
+		tcpConn.Close()
+		return nil, ErrPacketTooLarge
+	}
+
+	if err3 := handshake.WriteUint32(backendId).WriteBytes(config.gatewayKey).Send(); err3 != nil {
 		tcpConn.Close()
 		return nil, err3
 	}
 
-	return tcpConn, nil
+	// 直接断开连接，不能用读取超时来唤醒，因为'readPacket'设置的超时可能会把它覆盖掉
+	var stop = context.AfterFunc(ctx, tcpConn.abort)
+
+	var result, err4 = tcpConn.readPacket(config.handshakeTimeout, ErrHandshakeTimeout, true)
+
+	if !stop() {
+		tcpConn.Close()
+		return nil, ctx.Err()
+	}
+
+	if err4 != nil {
+		tcpConn.Close()
+		return nil, err4
+	}
+
+	if len(result) != padding+1 {
+		tcpConn.Close()
+		return nil, ErrGatewayBadHandshake
+	}
+
+	switch result[padding] {
+	case _GATEWAY_HANDSHAKE_ACCEPTED_:
+		tcpConn.Free(result)
+		return tcpConn, nil
+	case _GATEWAY_HANDSHAKE_UNKNOWN_BACKEND_:
+		err4 = ErrGatewayUnknownBackend
+	case _GATEWAY_HANDSHAKE_BACKEND_UNAVAILABLE_:
+		err4 = ErrGatewayBackendUnavailable
+	default:
+		err4 = ErrGatewayBadHandshake
+	}
+
+	tcpConn.Close()
+
+	return nil, err4
 }
 
 //
-// 你懂的。
+// 关闭连接，调用会马上返回，不会被对方拖住。发送队列中还没写出的消息包在后台继续写完，但最多等待一秒，避免对方不接收数据时一直占用连接。
+// 正在阻塞读取的调用会马上返回ErrConnClosed。
 //
 func (this *TcpConn) Close() error {
-	return this.conn.Close()
+	this.closeWait.Do(func() {
+		this.setErr(ErrConnClosed)
+
+		var flushTime = time.Now().Add(_CLOSE_FLUSH_TIME_)
+
+		this.flushTime.Store(flushTime.UnixNano())
+
+		this.closeOnce.Do(func() {
+			close(this.closeChan)
+		})
+
+		this.conn.SetWriteDeadline(flushTime)
+
+		// 唤醒正在读取的调用，读取出错时会发现连接已经关闭
+		this.conn.SetReadDeadline(time.Unix(1, 0))
+
+		go func() {
+			<-this.sendDone
+
+			this.conn.Close()
+		}()
+	})
+
+	return nil
+}
+
+//
+// 返回连接关闭的原因，连接还没关闭时返回nil。
+// 主动调用'Close'关闭的连接返回ErrConnClosed，超时断开的连接返回ErrIdleTimeout、ErrReadTimeout、ErrWriteTimeout等错误。
+//
+func (this *TcpConn) Err() error {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+
+	return this.closeErr
+}
+
+// 记录连接关闭的原因，只记录第一次
+func (this *TcpConn) setErr(err error) {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+
+	if this.closeErr == nil {
+		this.closeErr = err
+	}
+}
+
+// 是否已经调用过'Close'或者被'abort'断开
+func (this *TcpConn) closed() bool {
+	select {
+	case <-this.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// 因为超时等原因断开连接，并记录原因
+func (this *TcpConn) expire(reason error) error {
+	this.setErr(reason)
+	this.Close()
+
+	return reason
 }
 
 //
 // 读取一个消息包，调用会一只阻塞，直到收到完整消息包或者连接断开。
+// 出错时返回nil，需要知道具体原因请使用'ReadPacket'。
 //
 func (this *TcpConn) Read() []byte {
-	if _, err := io.ReadFull(this.conn, this.head); err != nil {
-		return nil
+	var buff, _ = this.ReadPacket()
+
+	return buff
+}
+
+//
+// 读取一个消息包，跟'Read'的区别是会返回具体的错误信息。
+// 连接关闭时返回ErrConnClosed，消息包超过内存池允许的长度时返回ErrPacketTooLarge，消息包没接收完整连接就断开时返回ErrShortRead。
+// 设置了超时的连接，超时以后连接会被关闭，并返回ErrIdleTimeout或ErrReadTimeout，请参考'WithIdleTimeout'和'WithReadTimeout'。
+// 对方断开连接时，这边的连接也会被关闭，发送协程随之退出。
+//
+func (this *TcpConn) ReadPacket() ([]byte, error) {
+	return this.readPacket(this.idleTimeout, ErrIdleTimeout, false)
+}
+
+//
+// 读取一个消息包，'waitTimeout'是等待消息包到达的最长时间，超时以后以'waitErr'为原因断开连接。
+// 'whole'为true时'waitTimeout'限制的是读完整个消息包的时间，用于握手和网关之间的心跳，对方发了一半就停下也会超时。
+//
+func (this *TcpConn) readPacket(waitTimeout time.Duration, waitErr error, whole bool) ([]byte, error) {
+	var deadline, readLimit time.Time
+
+	if waitTimeout > 0 {
+		deadline = time.Now().Add(waitTimeout)
 	}
 
-	var buff = this.memPool.Alloc(this.padding + getUint(this.head, this.pack))
+	this.setReadDeadline(deadline)
 
-	if buff == nil {
-		return nil
+	// 等到消息包的第一个字节到达才算开始读取消息包，之前只受'waitTimeout'限制，之后只受'readTimeout'限制
+	if _, err := this.reader.Peek(1); err != nil {
+		if this.closed() {
+			return nil, ErrConnClosed
+		}
+		if isTimeout(err) {
+			return nil, this.expire(waitErr)
+		}
+		return nil, this.readFailed(err, headReadError(err), err == io.EOF)
 	}
 
-	// 不等待空消息
-	if msg := buff[this.padding:]; len(msg) != 0 {
-		if _, err := io.ReadFull(this.conn, msg); err != nil {
-			return nil
+	var readErr = ErrReadTimeout
+
+	if whole {
+		readErr = waitErr
+	} else {
+		if this.readTimeout > 0 {
+			readLimit = time.Now().Add(this.readTimeout)
 		}
+
+		this.setReadDeadline(readLimit)
 	}
 
-	return buff
+	var buff, err = this.framer.ReadFrame(this.reader, this.memPool, this.padding)
+
+	if err != nil {
+		if this.closed() {
+			return nil, ErrConnClosed
+		}
+		if isTimeout(err) {
+			return nil, this.expire(readErr)
+		}
+		return nil, this.readFailed(err, bodyReadError(err), false)
+	}
+
+	return buff, nil
+}
+
+// 读取时连接本身断开了，就关闭连接让发送协程退出，否则要等到有人调用'Close'才会退出
+// 对方在两个消息包之间正常断开时可能只是关闭了写入的一端，这时仍然尽量写完发送队列，其它情况直接断开
+func (this *TcpConn) readFailed(err, result error, graceful bool) error {
+	var opErr *net.OpError
+
+	switch {
+	case graceful:
+		this.Close()
+	case err == io.EOF, err == io.ErrUnexpectedEOF, errors.As(err, &opErr):
+		this.setErr(result)
+		this.abort()
+	}
+
+	return result
+}
+
+func (this *TcpConn) setReadDeadline(deadline time.Time) {
+	if deadline.IsZero() && !this.hasDeadline {
+		return
+	}
+
+	this.conn.SetReadDeadline(deadline)
+	this.hasDeadline = !deadline.IsZero()
+}
+
+//
+// 把'Read'或'ReadPacket'返回的内存还给内存池，只有内存池实现了'RecyclableMemPool'接口时才有效果。
+// 调用之后就不能再访问这块内存，包括基于它创建的TcpInput。
+//
+func (this *TcpConn) Free(buff []byte) {
+	freeBuff(this.memPool, buff)
 }
 
 //
 // 读取一个消息包，跟'Read'不同之处是返回的数据类型不一样。
 //
 func (this *TcpConn) ReadPackage() *TcpInput {
-	var data = this.Read()
+	var input, _ = this.ReadInput()
+
+	return input
+}
+
+//
+// 读取一个消息包，跟'ReadPacket'不同之处是返回的数据类型不一样。
+//
+func (this *TcpConn) ReadInput() (*TcpInput, error) {
+	var data, err = this.ReadPacket()
 
-	if data != nil {
-		return NewTcpInput(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	var input = NewTcpInputWithOrder(data, this.order)
+
+	input.safe = this.safeInput
+
+	return input, nil
 }
 
 //
-// 创建一个用于发送的消息包，消息包内容填充完毕，请调用包实例的'Send'方法发送
+// 创建一个用于发送的消息包，消息包内容填充完毕，请调用包实例的'Send'方法发送。
+// 消息包超过内存池允许的长度，或者长度不符合分帧规则时返回nil。
 //
 func (this *TcpConn) NewPackage(size int) *TcpOutput {
-	var buff = this.memPool.Alloc(this.pack + size)
+	var head, tail, err = this.framer.FrameSize(size)
+
+	if err != nil {
+		return nil
+	}
+
+	var buff = this.memPool.Alloc(head + size + tail)
 
 	if buff == nil {
 		return nil
 	}
 
-	setUint(buff, this.pack, size)
+	this.framer.EncodeFrame(buff, size)
 
-	return &TcpOutput{this, buff, buff[this.pack:]}
+	return &TcpOutput{owner: this, buff: buff, Data: buff[head : head+size], order: this.order}
 }
 
-func (this *TcpConn) sendRaw(msg []byte) error {
-	_, err := this.conn.Write(msg)
-	return err
+//
+// 创建一个构建模式的消息包，不需要预先知道消息包长度，写入时空间不够会自动从内存池申请更大的内存，'Send'时再填写帧头部。
+// 参数'size'是预计的消息内容长度，估计准确的话不需要扩容，跟'NewPackage'一样没有额外的复制。
+// 消息包超过内存池允许的长度时，'Send'返回ErrPacketTooLarge。
+//
+func (this *TcpConn) NewBuilder(size int) *TcpOutput {
+	var head, tail, err = this.framer.FrameSize(size)
+
+	if err != nil {
+		head, tail = 0, 0
+	}
+
+	var buff = this.memPool.Alloc(head + size + tail)
+
+	if buff == nil {
+		return nil
+	}
+
+	return &TcpOutput{owner: this, buff: buff, Data: buff[head:], order: this.order, builder: true, head: head}
 }
+